@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+
+	"github.com/barrydeen/haven/pkg/wot"
+)
+
+const (
+	accessListsPollInterval = 5 * time.Second
+	accessExpiryInterval    = time.Minute
+)
+
+// PubKeySet is a set of hex pubkeys that can be swapped atomically while being read concurrently.
+type PubKeySet struct {
+	pubkeys atomic.Pointer[map[string]struct{}]
+}
+
+func NewPubKeySet(pubkeys map[string]struct{}) *PubKeySet {
+	s := &PubKeySet{}
+	s.Store(pubkeys)
+	return s
+}
+
+func (s *PubKeySet) Has(pubkey string) bool {
+	_, ok := (*s.pubkeys.Load())[pubkey]
+	return ok
+}
+
+func (s *PubKeySet) Len() int {
+	return len(*s.pubkeys.Load())
+}
+
+// Keys returns the pubkeys in the set, in no particular order.
+func (s *PubKeySet) Keys() []string {
+	return slices.Collect(maps.Keys(*s.pubkeys.Load()))
+}
+
+// Load returns the current set. It must be treated as read-only.
+func (s *PubKeySet) Load() map[string]struct{} {
+	return *s.pubkeys.Load()
+}
+
+func (s *PubKeySet) Store(pubkeys map[string]struct{}) {
+	s.pubkeys.Store(&pubkeys)
+}
+
+// whitelistChanged is signalled every time a reload changes the whitelisted pubkeys.
+var whitelistChanged = make(chan struct{}, 1)
+
+func notifyWhitelistChanged() {
+	select {
+	case whitelistChanged <- struct{}{}:
+	default:
+	}
+}
+
+// watchAccessLists reloads the whitelist and blacklist files when they change on disk or when
+// the process receives a SIGHUP.
+func watchAccessLists(ctx context.Context) {
+	if config.WhitelistedNpubsFile == "" && config.BlacklistedNpubsFile == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(accessListsPollInterval)
+	defer ticker.Stop()
+
+	whitelistStamp := fileStamp(config.WhitelistedNpubsFile)
+	blacklistStamp := fileStamp(config.BlacklistedNpubsFile)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("🔄 SIGHUP received, reloading access lists")
+			whitelistStamp = fileStamp(config.WhitelistedNpubsFile)
+			blacklistStamp = fileStamp(config.BlacklistedNpubsFile)
+			reloadAccessLists(ctx)
+		case <-ticker.C:
+			w := fileStamp(config.WhitelistedNpubsFile)
+			b := fileStamp(config.BlacklistedNpubsFile)
+			if w == whitelistStamp && b == blacklistStamp {
+				continue
+			}
+			whitelistStamp, blacklistStamp = w, b
+			slog.Info("🔄 access list files changed, reloading")
+			reloadAccessLists(ctx)
+		}
+	}
+}
+
+// accessStore persists the whitelisted and blacklisted pubkeys. It is set up by newDBBackends.
+var accessStore AccessStore
+
+// initAccessLists imports the access list files into the access store and loads the effective
+// access lists from it. It must run after the databases are initialized.
+func initAccessLists(ctx context.Context) {
+	if err := accessStore.migrateKind(ctx); err != nil {
+		slog.Error("🚫 error migrating access list entries", "error", err)
+	}
+	reloadAccessLists(ctx)
+}
+
+// reloadAccessLists syncs both access list files into the access store and swaps the in-memory
+// sets. A file that can't be read is skipped, keeping the entries previously imported from it.
+func reloadAccessLists(ctx context.Context) {
+	// The blacklist file is synced first, as it wins over the whitelist file
+	for _, f := range []struct{ path, list string }{
+		{config.BlacklistedNpubsFile, accessDeny},
+		{config.WhitelistedNpubsFile, accessAllow},
+	} {
+		if err := syncAccessListFile(ctx, f.path, f.list); err != nil {
+			slog.Error("🚫 error importing access list file, keeping the current entries", "file", f.path, "error", err)
+		}
+	}
+
+	applyAccessLists(ctx)
+}
+
+// syncAccessListFile makes the entries imported from an access list file match its content.
+// Entries added through the management API take precedence and are left untouched, and so are the
+// entries imported from the blacklist file when syncing the whitelist file.
+func syncAccessListFile(ctx context.Context, filePath string, list string) error {
+	if filePath == "" {
+		return nil
+	}
+	fileEntries, err := readNpubsFile(filePath)
+	if err != nil {
+		return err
+	}
+	entries, err := accessStore.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list access entries: %w", err)
+	}
+
+	now := nostr.Now()
+	current := make(map[string]AccessEntry, len(entries))
+	for _, entry := range entries {
+		current[entry.PubKey] = entry
+	}
+
+	added := 0
+	for pubkey, fe := range fileEntries {
+		old, ok := current[pubkey]
+		if ok && (old.Source == accessSourceAPI || (old.List == accessDeny && list == accessAllow)) {
+			continue
+		}
+		if ok && old.List == list && old.Reason == fe.Reason && old.ExpiresAt == fe.ExpiresAt {
+			continue
+		}
+		entry := AccessEntry{
+			PubKey:    pubkey,
+			List:      list,
+			Reason:    fe.Reason,
+			Source:    accessSourceFile,
+			AddedAt:   now,
+			ExpiresAt: fe.ExpiresAt,
+		}
+		if ok && old.List == list {
+			entry.AddedAt = old.AddedAt
+		}
+		if err := accessStore.Put(ctx, entry); err != nil {
+			return fmt.Errorf("failed to store access entry: %w", err)
+		}
+		added++
+	}
+
+	removed := 0
+	for pubkey, old := range current {
+		if _, ok := fileEntries[pubkey]; ok || old.Source != accessSourceFile || old.List != list {
+			continue
+		}
+		if err := accessStore.Remove(ctx, pubkey); err != nil {
+			return fmt.Errorf("failed to remove access entry: %w", err)
+		}
+		removed++
+	}
+
+	if added > 0 || removed > 0 {
+		slog.Info("📥 access list file imported", "file", filePath, "list", list, "added", added, "removed", removed)
+	}
+	return nil
+}
+
+// applyAccessLists computes the effective whitelist and blacklist from the unexpired entries in
+// the access store and swaps them in.
+func applyAccessLists(ctx context.Context) {
+	entries, err := accessStore.List(ctx)
+	if err != nil {
+		slog.Error("🚫 error loading access lists, keeping the current ones", "error", err)
+		return
+	}
+
+	now := nostr.Now()
+	whitelist := make(map[string]struct{})
+	blacklist := make(map[string]struct{})
+	for _, entry := range entries {
+		if entry.Expired(now) {
+			continue
+		}
+		switch entry.List {
+		case accessAllow:
+			whitelist[entry.PubKey] = struct{}{}
+		case accessDeny:
+			blacklist[entry.PubKey] = struct{}{}
+		}
+	}
+
+	// Relay owner is always whitelisted
+	whitelist[config.OwnerPubKey] = struct{}{}
+	delete(blacklist, config.OwnerPubKey)
+
+	whitelistUpdated := !maps.Equal(whitelist, config.WhitelistedPubKeys.Load())
+	blacklistUpdated := !maps.Equal(blacklist, config.BlacklistedPubKeys.Load())
+	if !whitelistUpdated && !blacklistUpdated {
+		slog.Debug("ℹ️ access lists unchanged")
+		return
+	}
+
+	config.WhitelistedPubKeys.Store(whitelist)
+	config.BlacklistedPubKeys.Store(blacklist)
+	slog.Info("✅ access lists updated", "👥whitelisted", len(whitelist), "🚷blacklisted", len(blacklist))
+
+	if whitelistUpdated {
+		wot.UpdateWhitelist(ctx, whitelist)
+		notifyWhitelistChanged()
+	}
+}
+
+// expireAccessEntries periodically removes the expired entries from the access store.
+func expireAccessEntries(ctx context.Context) {
+	ticker := time.NewTicker(accessExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			entries, err := accessStore.List(ctx)
+			if err != nil {
+				slog.Error("🚫 error listing access entries", "error", err)
+				continue
+			}
+			now := nostr.Now()
+			expired := 0
+			for _, entry := range entries {
+				if !entry.Expired(now) {
+					continue
+				}
+				if err := accessStore.Remove(ctx, entry.PubKey); err != nil {
+					slog.Error("🚫 error removing expired access entry", "pubkey", entry.PubKey, "error", err)
+					continue
+				}
+				slog.Info("⌛ access entry expired", "pubkey", entry.PubKey, "list", entry.List)
+				expired++
+			}
+			if expired > 0 {
+				applyAccessLists(ctx)
+			}
+		}
+	}
+}
+
+// fileStamp identifies the current version of a file by its modification time and size.
+func fileStamp(filePath string) string {
+	if filePath == "" {
+		return ""
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// accessFileEntry is an element of an access list file: either a plain npub or an object with
+// the npub and, optionally, a reason and an RFC 3339 expiration date.
+type accessFileEntry struct {
+	Npub      string `json:"npub"`
+	Reason    string `json:"reason"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+func (e *accessFileEntry) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.Npub); err == nil {
+		return nil
+	}
+	type plain accessFileEntry
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// npubsFileEntry is what an access list file says about a pubkey.
+type npubsFileEntry struct {
+	Reason    string
+	ExpiresAt nostr.Timestamp
+}
+
+// readNpubsFile parses an access list file into its entries, keyed by hex pubkey. Entries that
+// have already expired are left out.
+func readNpubsFile(filePath string) (map[string]npubsFileEntry, error) {
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var fileEntries []accessFileEntry
+	if err := json.Unmarshal(file, &fileEntries); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	now := nostr.Now()
+	entries := make(map[string]npubsFileEntry, len(fileEntries))
+	for _, fe := range fileEntries {
+		npub := strings.TrimSpace(fe.Npub)
+		prefix, v, err := nip19.Decode(npub)
+		if err != nil || prefix != "npub" {
+			return nil, fmt.Errorf("invalid npub %q", npub)
+		}
+		entry := npubsFileEntry{Reason: fe.Reason}
+		if fe.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, fe.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expiration date for %s: %w", npub, err)
+			}
+			entry.ExpiresAt = nostr.Timestamp(expiresAt.Unix())
+			if entry.ExpiresAt <= now {
+				continue
+			}
+		}
+		entries[v.(string)] = entry
+	}
+	return entries, nil
+}
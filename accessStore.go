@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// accessEntryKind is the kind of the fake events used to store access list entries. It is a regular
+// kind, as ephemeral kinds aren't meant to be stored.
+const accessEntryKind = 4243
+
+// legacyAccessEntryKind is the ephemeral kind access list entries used to be stored with.
+const legacyAccessEntryKind = 24243
+
+const (
+	accessAllow = "allow"
+	accessDeny  = "deny"
+
+	accessSourceFile = "file"
+	accessSourceAPI  = "api"
+)
+
+// AccessEntry allows or denies a pubkey access to the relays.
+type AccessEntry struct {
+	PubKey    string
+	List      string // accessAllow or accessDeny
+	Reason    string
+	Source    string // accessSourceFile or accessSourceAPI
+	AddedAt   nostr.Timestamp
+	ExpiresAt nostr.Timestamp // 0 if the entry never expires
+}
+
+func (e AccessEntry) Expired(now nostr.Timestamp) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// AccessStore uses fake events to keep track of the whitelisted and blacklisted pubkeys, with at
+// most one entry per pubkey.
+type AccessStore struct {
+	DBBackend
+}
+
+// Put replaces the entry for the pubkey, if any.
+func (s AccessStore) Put(ctx context.Context, entry AccessEntry) error {
+	if err := s.Remove(ctx, entry.PubKey); err != nil {
+		return err
+	}
+
+	evt := &nostr.Event{
+		PubKey:    entry.PubKey,
+		Kind:      accessEntryKind,
+		CreatedAt: entry.AddedAt,
+		Tags: nostr.Tags{
+			{"list", entry.List},
+			{"source", entry.Source},
+			{"reason", entry.Reason},
+		},
+	}
+	if entry.ExpiresAt != 0 {
+		evt.Tags = append(evt.Tags, nostr.Tag{"expiration", strconv.FormatInt(int64(entry.ExpiresAt), 10)})
+	}
+	evt.ID = evt.GetID()
+	return s.DBBackend.SaveEvent(ctx, evt)
+}
+
+// Remove deletes the entry for the pubkey, if any.
+func (s AccessStore) Remove(ctx context.Context, pubkey string) error {
+	events, err := eventstore.RelayWrapper{Store: s.DBBackend}.QuerySync(ctx, nostr.Filter{
+		Authors: []string{pubkey},
+		Kinds:   []int{accessEntryKind},
+	})
+	if err != nil {
+		return err
+	}
+	for _, evt := range events {
+		if err := s.DBBackend.DeleteEvent(ctx, evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns every entry, including the expired ones.
+func (s AccessStore) List(ctx context.Context) ([]AccessEntry, error) {
+	var entries []AccessEntry
+	err := scanEvents(ctx, s.DBBackend, nostr.Filter{Kinds: []int{accessEntryKind}}, func(evt *nostr.Event) {
+		entries = append(entries, parseAccessEntry(evt))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// migrateKind stores the entries saved with the legacy kind again with the current one.
+func (s AccessStore) migrateKind(ctx context.Context) error {
+	var legacy []*nostr.Event
+	err := scanEvents(ctx, s.DBBackend, nostr.Filter{Kinds: []int{legacyAccessEntryKind}}, func(evt *nostr.Event) {
+		legacy = append(legacy, evt)
+	})
+	if err != nil {
+		return err
+	}
+	for _, evt := range legacy {
+		if err := s.Put(ctx, parseAccessEntry(evt)); err != nil {
+			return err
+		}
+		if err := s.DBBackend.DeleteEvent(ctx, evt); err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		slog.Info("📦 migrated access list entries", "count", len(legacy))
+	}
+	return nil
+}
+
+func parseAccessEntry(evt *nostr.Event) AccessEntry {
+	entry := AccessEntry{
+		PubKey:  evt.PubKey,
+		AddedAt: evt.CreatedAt,
+	}
+	if tag := evt.Tags.Find("list"); tag != nil {
+		entry.List = tag[1]
+	}
+	if tag := evt.Tags.Find("source"); tag != nil {
+		entry.Source = tag[1]
+	}
+	if tag := evt.Tags.Find("reason"); tag != nil {
+		entry.Reason = tag[1]
+	}
+	if tag := evt.Tags.Find("expiration"); tag != nil {
+		expiresAt, _ := strconv.ParseInt(tag[1], 10, 64)
+		entry.ExpiresAt = nostr.Timestamp(expiresAt)
+	}
+	return entry
+}
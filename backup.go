@@ -20,6 +20,7 @@ func runBackup(ctx context.Context) {
 	output := backupCmd.String("output", "", "Output file (shorthand)")
 	outputShort := backupCmd.String("o", "", "Output file (shorthand)")
 	toCloud := backupCmd.Bool("to-cloud", false, "Upload backup to cloud storage")
+	media := backupCmd.Bool("media", false, "Also back up the Blossom media files that aren't backed up yet")
 
 	args := os.Args[2:]
 	var flags []string
@@ -29,8 +30,8 @@ func runBackup(ctx context.Context) {
 		if strings.HasPrefix(arg, "-") {
 			flags = append(flags, arg)
 			// Check if it's a flag that takes a value
-			// In our case, all flags (relay, r, output, o) take values, but to-cloud does not.
-			if arg == "--to-cloud" {
+			// In our case, all flags (relay, r, output, o) take values, but to-cloud and media do not.
+			if arg == "--to-cloud" || arg == "--media" {
 				continue
 			}
 			if !strings.Contains(arg, "=") && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
@@ -69,6 +70,7 @@ func runBackup(ctx context.Context) {
 	}
 
 	initDBs()
+	defer closeDBs()
 
 	if strings.HasSuffix(fileName, ".jsonl") {
 		if targetRelay == "" {
@@ -77,14 +79,13 @@ func runBackup(ctx context.Context) {
 		if err := exportToJSONL(ctx, targetRelay, fileName); err != nil {
 			log.Fatal("🚫 export failed:", err)
 		}
-	} else {
-		if err := exportToZip(ctx, fileName); err != nil {
-			log.Fatal("🚫 backup failed:", err)
-		}
+	} else if err := exportToZip(ctx, fileName); err != nil {
+		log.Fatal("🚫 backup failed:", err)
 	}
 
+	var cloudProvider cloud.Storage
 	if *toCloud {
-		cloudProvider, err := getCloudProvider()
+		cloudProvider, err = getCloudProvider()
 		if err != nil {
 			log.Fatal("🚫 ", err)
 		}
@@ -92,6 +93,14 @@ func runBackup(ctx context.Context) {
 			log.Fatal("🚫 ", err)
 		}
 	}
+
+	// The media archives and manifest are uploaded as they are written
+	if *media && !strings.HasSuffix(fileName, ".jsonl") {
+		initBlobStorage()
+		if _, err := exportMedia(ctx, fileName, cloudProvider); err != nil {
+			log.Fatal("🚫 media backup failed:", err)
+		}
+	}
 }
 
 func runRestore(ctx context.Context) {
@@ -147,8 +156,9 @@ func runRestore(ctx context.Context) {
 		fileName = targetInput
 	}
 
+	var cloudProvider cloud.Storage
 	if *fromCloud {
-		cloudProvider, err := getCloudProvider()
+		cloudProvider, err = getCloudProvider()
 		if err != nil {
 			log.Fatal("🚫 ", err)
 		}
@@ -158,6 +168,7 @@ func runRestore(ctx context.Context) {
 	}
 
 	initDBs()
+	defer closeDBs()
 
 	if strings.HasSuffix(fileName, ".jsonl") {
 		if targetRelay == "" {
@@ -167,9 +178,13 @@ func runRestore(ctx context.Context) {
 			log.Fatal("🚫 restore failed:", err)
 		}
 	} else {
+		initBlobStorage()
 		if err := importFromZip(ctx, fileName); err != nil {
 			log.Fatal("🚫 restore failed:", err)
 		}
+		if err := importMedia(ctx, fileName, cloudProvider); err != nil {
+			log.Fatal("🚫 media restore failed:", err)
+		}
 	}
 }
 
@@ -194,25 +209,50 @@ func startPeriodicCloudBackups(ctx context.Context) {
 			return
 
 		case <-ticker.C:
-			log.Println("⏰ starting periodic backup...")
-			if err := exportToZip(ctx, zipFileName); err != nil {
-				log.Println("🚫 error exporting to zip:", err)
-				continue
-			}
-			if err := uploadBackupToCloud(ctx, cloudProvider, zipFileName); err != nil {
-				log.Println("🚫 error uploading to cloud:", err)
-				continue
-			}
-			// delete the file
-			err = os.Remove(zipFileName)
-			if err != nil {
-				log.Println("🚫 error deleting local backup file:", err)
+			// Register the backup so a shutdown waits for it before closing the databases
+			if !background.Add() {
+				return
 			}
+			runPeriodicCloudBackup(ctx, cloudProvider, zipFileName)
+			background.Done()
 		}
 	}
 }
 
-func getCloudProvider() (cloud.Provider, error) {
+func runPeriodicCloudBackup(ctx context.Context, cloudProvider cloud.Storage, zipFileName string) {
+	log.Println("⏰ starting periodic backup...")
+	if err := exportToZip(ctx, zipFileName); err != nil {
+		log.Println("🚫 error exporting to zip:", err)
+		return
+	}
+	if err := uploadBackupToCloud(ctx, cloudProvider, zipFileName); err != nil {
+		log.Println("🚫 error uploading to cloud:", err)
+		return
+	}
+	// delete the file
+	if err := os.Remove(zipFileName); err != nil {
+		log.Println("🚫 error deleting local backup file:", err)
+	}
+
+	if !config.BackupMedia {
+		return
+	}
+	// The manifest is read from the bucket, so nothing needs to be kept locally
+	archiveName, err := exportMedia(ctx, zipFileName, cloudProvider)
+	for _, fileName := range []string{archiveName, mediaManifestName(zipFileName)} {
+		if fileName == "" {
+			continue
+		}
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			log.Println("🚫 error deleting local backup file:", err)
+		}
+	}
+	if err != nil {
+		log.Println("🚫 error backing up media:", err)
+	}
+}
+
+func getCloudProvider() (cloud.Storage, error) {
 	if config.BackupProvider == "none" || config.BackupProvider == "" {
 		return nil, fmt.Errorf("no backup provider set")
 	} else if config.BackupProvider != "s3" {
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/barrydeen/haven/internal/cloud"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Media files are backed up apart from the databases, and only once: each backup with media adds the
+// blobs that aren't backed up yet to a new media archive next to the backup, and records in the media
+// manifest which archive holds each blob.
+
+// blobEntryPrefix is the folder of the media archives holding the Blossom blobs, named after their hash.
+const blobEntryPrefix = "blossom/"
+
+// mediaManifest lists the blobs already backed up, by hash, with the media archive holding each of them.
+type mediaManifest struct {
+	Blobs map[string]string `json:"blobs"`
+}
+
+// mediaManifestName returns the name of the media manifest of a backup, e.g. haven_backup.media.json.
+func mediaManifestName(backupFileName string) string {
+	return strings.TrimSuffix(backupFileName, ".zip") + ".media.json"
+}
+
+// mediaArchiveName returns the name of a new media archive of a backup, e.g.
+// haven_backup.media-20250101T000000.000000000Z.zip. The time is precise enough that an archive is never
+// replaced by the next one.
+func mediaArchiveName(backupFileName string, t time.Time) string {
+	return strings.TrimSuffix(backupFileName, ".zip") + ".media-" + t.UTC().Format("20060102T150405.000000000Z") + ".zip"
+}
+
+// loadMediaManifest reads a media manifest from the cloud storage if there is one, or else from the
+// local file. A missing manifest is empty, nothing has been backed up yet.
+func loadMediaManifest(ctx context.Context, manifestName string, storage cloud.Storage) (*mediaManifest, error) {
+	var r io.ReadCloser
+	var err error
+	if storage != nil {
+		r, err = storage.Open(ctx, config.S3Config.BucketName, manifestName)
+	} else {
+		r, err = os.Open(manifestName)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return &mediaManifest{Blobs: make(map[string]string)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest mediaManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid media manifest %s: %w", manifestName, err)
+	}
+	if manifest.Blobs == nil {
+		manifest.Blobs = make(map[string]string)
+	}
+	for hash, archive := range manifest.Blobs {
+		// Archives are next to the manifest
+		if !isBlobHash(hash) || archive == "" || filepath.Base(archive) != archive {
+			return nil, fmt.Errorf("invalid media manifest %s: bad entry %s: %s", manifestName, hash, archive)
+		}
+	}
+	return &manifest, nil
+}
+
+// save writes the manifest to a temporary file, which then replaces the manifest.
+func (m *mediaManifest) save(manifestName string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpFileName := manifestName + ".tmp"
+	if err := os.WriteFile(tmpFileName, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, manifestName)
+}
+
+// indexedBlobs returns the hashes of the blobs in the Blossom index.
+func indexedBlobs(ctx context.Context) ([]string, error) {
+	indexed := make(map[string]struct{})
+	err := scanEvents(ctx, blossomDB, nostr.Filter{Kinds: []int{24242}}, func(event *nostr.Event) {
+		if x := event.Tags.Find("x"); x != nil && isBlobHash(x[1]) {
+			indexed[x[1]] = struct{}{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(indexed))
+	for hash := range indexed {
+		hashes = append(hashes, hash)
+	}
+	slices.Sort(hashes)
+	return hashes, nil
+}
+
+// exportMedia backs up the blobs in the Blossom index that aren't in the media manifest yet to a new
+// media archive, and adds them to the manifest. With a cloud storage, the manifest is read from it, and
+// the archive and the manifest are uploaded to it, the manifest last so that it never lists blobs that
+// aren't uploaded. It returns the name of the new archive, or "" if there was nothing new to back up.
+func exportMedia(ctx context.Context, backupFileName string, storage cloud.Storage) (string, error) {
+	manifestName := mediaManifestName(backupFileName)
+	manifest, err := loadMediaManifest(ctx, manifestName, storage)
+	if err != nil {
+		return "", fmt.Errorf("error reading media manifest: %w", err)
+	}
+	hashes, err := indexedBlobs(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error listing blobs: %w", err)
+	}
+	var pending []string
+	for _, hash := range hashes {
+		if _, ok := manifest.Blobs[hash]; !ok {
+			pending = append(pending, hash)
+		}
+	}
+
+	archiveName := ""
+	if len(pending) > 0 {
+		archiveName = mediaArchiveName(backupFileName, time.Now())
+		stored, err := writeMediaArchive(ctx, archiveName, pending)
+		if err != nil {
+			return "", err
+		}
+		if len(stored) == 0 {
+			removeMediaArchive(archiveName)
+			archiveName = ""
+		} else {
+			if storage != nil {
+				if err := uploadBackupToCloud(ctx, storage, archiveName); err != nil {
+					removeMediaArchive(archiveName)
+					return "", err
+				}
+			}
+			for _, hash := range stored {
+				manifest.Blobs[hash] = filepath.Base(archiveName)
+			}
+		}
+	}
+
+	if err := manifest.save(manifestName); err != nil {
+		return archiveName, fmt.Errorf("error saving media manifest: %w", err)
+	}
+	if storage != nil {
+		if err := uploadBackupToCloud(ctx, storage, manifestName); err != nil {
+			return archiveName, err
+		}
+	}
+	slog.Info("✅ media backup complete", "manifest", manifestName, "archive", archiveName, "already_backed_up", len(hashes)-len(pending))
+	return archiveName, nil
+}
+
+// removeMediaArchive deletes a media archive that isn't in the manifest.
+func removeMediaArchive(archiveName string) {
+	if err := os.Remove(archiveName); err != nil {
+		slog.Error("❌ error deleting media archive", "file", archiveName, "error", err)
+	}
+}
+
+// errCorruptedBlob is returned by exportBlob when the content of a blob doesn't match its hash.
+var errCorruptedBlob = errors.New("blob content does not match its hash")
+
+// writeMediaArchive writes the blobs to a new media archive, and returns the hashes of those that were
+// backed up. Blobs missing from the blob storage or corrupted in it are left out.
+func writeMediaArchive(ctx context.Context, archiveName string, hashes []string) ([]string, error) {
+	var stored []string
+	missing, corrupted := 0, 0
+	err := writeZipFile(archiveName, func(zw *zip.Writer) error {
+		for _, hash := range hashes {
+			err := exportBlob(ctx, zw, hash)
+			if errors.Is(err, os.ErrNotExist) {
+				slog.Warn("⚠️ blob is missing from the storage, skipping", "sha256", hash)
+				missing++
+				continue
+			} else if errors.Is(err, errCorruptedBlob) {
+				slog.Error("🚫 blob is corrupted in the storage, skipping", "sha256", hash, "error", err)
+				corrupted++
+				continue
+			} else if err != nil {
+				return fmt.Errorf("error exporting blob %s: %w", hash, err)
+			}
+			stored = append(stored, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("📦 exported blobs", "file", archiveName, "count", len(stored), "missing", missing, "corrupted", corrupted)
+	return stored, nil
+}
+
+// exportBlob adds a blob from the blob storage to the zip, checking its content against its hash along
+// the way. The entry of a corrupted blob can't be taken back out of the zip, but it is left out of the
+// manifest, so it's never restored.
+func exportBlob(ctx context.Context, zw *zip.Writer, hash string) error {
+	blob, err := blobStorage.Load(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// Media files are usually compressed already
+	writer, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     blobEntryPrefix + hash,
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(writer, h), blob); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return fmt.Errorf("%w: got %s", errCorruptedBlob, actual)
+	}
+	return nil
+}
+
+// importMedia restores the blobs in the restored Blossom index that are missing from the blob storage,
+// from the media archives listed in the manifest of the backup. With a cloud storage, the manifest is
+// read from it and the archives needed are downloaded, then deleted once restored.
+func importMedia(ctx context.Context, backupFileName string, storage cloud.Storage) error {
+	manifestName := mediaManifestName(backupFileName)
+	manifest, err := loadMediaManifest(ctx, manifestName, storage)
+	if err != nil {
+		return fmt.Errorf("error reading media manifest: %w", err)
+	}
+	if len(manifest.Blobs) == 0 {
+		return nil
+	}
+	hashes, err := indexedBlobs(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing blobs: %w", err)
+	}
+
+	byArchive := make(map[string][]string)
+	notBackedUp := 0
+	for _, hash := range hashes {
+		archive, ok := manifest.Blobs[hash]
+		if !ok {
+			notBackedUp++
+			continue
+		}
+		if exists, err := blobStorage.Exists(ctx, hash); err != nil {
+			return fmt.Errorf("error checking blob %s: %w", hash, err)
+		} else if exists {
+			continue
+		}
+		byArchive[archive] = append(byArchive[archive], hash)
+	}
+	if notBackedUp > 0 {
+		slog.Warn("⚠️ some indexed blobs aren't in the media backup", "count", notBackedUp)
+	}
+
+	restored, failed := 0, 0
+	for _, archive := range slices.Sorted(maps.Keys(byArchive)) {
+		archiveName := filepath.Join(filepath.Dir(backupFileName), archive)
+		count, err := importMediaArchive(ctx, archiveName, byArchive[archive], storage)
+		if err != nil {
+			slog.Error("❌ error restoring media archive", "file", archiveName, "error", err)
+		}
+		restored += count
+		failed += len(byArchive[archive]) - count
+	}
+
+	slog.Info("📥 restored blobs", "count", restored, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d blobs couldn't be restored", failed)
+	}
+	return nil
+}
+
+// importMediaArchive restores the blobs from a media archive, and returns how many were restored.
+func importMediaArchive(ctx context.Context, archiveName string, hashes []string, storage cloud.Storage) (int, error) {
+	if storage != nil {
+		if err := downloadBackupFromCloud(ctx, storage, archiveName); err != nil {
+			return 0, err
+		}
+		defer removeMediaArchive(archiveName)
+	}
+	archive, err := zip.OpenReader(archiveName)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+	restored := 0
+	for _, hash := range hashes {
+		file, ok := files[blobEntryPrefix+hash]
+		if !ok {
+			slog.Error("❌ blob is missing from its media archive", "sha256", hash, "file", archiveName)
+			continue
+		}
+		if err := importBlob(ctx, hash, file); err != nil {
+			slog.Error("❌ error restoring blob", "sha256", hash, "file", archiveName, "error", err)
+			continue
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// importBlob restores a blob from a media archive, checking its content still matches its hash.
+func importBlob(ctx context.Context, hash string, file *zip.File) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// The Blossom index is restored before the blobs
+	return storeVerifiedBlob(ctx, blobStorage, hash, rc, int64(file.UncompressedSize64), indexedBlobType(ctx, hash))
+}
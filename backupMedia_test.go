@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/barrydeen/haven/internal/cloud"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupTestMediaBackup indexes and stores the blobs in memory, and moves to an empty folder for the
+// backup files.
+func setupTestMediaBackup(t *testing.T, blobs ...[]byte) {
+	t.Helper()
+	oldDB := blossomDB
+	t.Cleanup(func() {
+		blossomDB = oldDB
+	})
+	setupTestBlobStorage(t)
+	blossomDB = newMemoryDB(t)
+	t.Chdir(t.TempDir())
+	addTestBlobs(t, blobs...)
+}
+
+func addTestBlobs(t *testing.T, blobs ...[]byte) {
+	t.Helper()
+	ctx := context.Background()
+	index := blossom.EventStoreBlobIndexWrapper{Store: blossomDB, ServiceURL: "http://localhost:3355"}
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	for _, data := range blobs {
+		hash := hashOf(data)
+		bd := blossom.BlobDescriptor{SHA256: hash, Size: len(data), Type: "text/plain", Uploaded: nostr.Now()}
+		if err := index.Keep(ctx, bd, pubkey); err != nil {
+			t.Fatal(err)
+		}
+		if err := blobStorage.Store(ctx, hash, bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// archiveBlobs returns the hashes of the blobs in a media archive.
+func archiveBlobs(t *testing.T, archiveName string) []string {
+	t.Helper()
+	archive, err := zip.OpenReader(archiveName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	var hashes []string
+	for _, file := range archive.File {
+		hashes = append(hashes, file.Name[len(blobEntryPrefix):])
+	}
+	slices.Sort(hashes)
+	return hashes
+}
+
+// checkRestoredBlobs deletes the blobs from the blob storage, restores them and checks their content.
+func checkRestoredBlobs(t *testing.T, storage cloud.Storage, blobs ...[]byte) {
+	t.Helper()
+	ctx := context.Background()
+	for _, data := range blobs {
+		if err := blobStorage.Delete(ctx, hashOf(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := importMedia(ctx, "haven_backup.zip", storage); err != nil {
+		t.Fatalf("importMedia: %v", err)
+	}
+	for _, data := range blobs {
+		blob, err := blobStorage.Load(ctx, hashOf(data))
+		if err != nil {
+			t.Fatalf("restored blob: %v", err)
+		}
+		got, err := io.ReadAll(blob)
+		blob.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("restored blob = %q, %v, want %q", got, err, data)
+		}
+	}
+}
+
+func TestMediaBackup(t *testing.T) {
+	a, b, c := []byte("first media file"), []byte("second media file"), []byte("third media file")
+	setupTestMediaBackup(t, a, b)
+	ctx := context.Background()
+
+	first, err := exportMedia(ctx, "haven_backup.zip", nil)
+	if err != nil {
+		t.Fatalf("exportMedia: %v", err)
+	}
+	if got, want := archiveBlobs(t, first), slices.Sorted(slices.Values([]string{hashOf(a), hashOf(b)})); !slices.Equal(got, want) {
+		t.Errorf("first archive holds %v, want %v", got, want)
+	}
+
+	// Nothing new, no archive
+	if archiveName, err := exportMedia(ctx, "haven_backup.zip", nil); err != nil || archiveName != "" {
+		t.Errorf("exportMedia without new blobs = %q, %v, want no archive", archiveName, err)
+	}
+
+	// Only the new blob goes to the next archive
+	addTestBlobs(t, c)
+	second, err := exportMedia(ctx, "haven_backup.zip", nil)
+	if err != nil {
+		t.Fatalf("exportMedia: %v", err)
+	}
+	if got := archiveBlobs(t, second); !slices.Equal(got, []string{hashOf(c)}) {
+		t.Errorf("second archive holds %v, want [%s]", got, hashOf(c))
+	}
+
+	manifest, err := loadMediaManifest(ctx, "haven_backup.media.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := manifest.Blobs[hashOf(a)]; got != first {
+		t.Errorf("manifest lists %s in %q, want %q", hashOf(a), got, first)
+	}
+	if got := manifest.Blobs[hashOf(c)]; got != second {
+		t.Errorf("manifest lists %s in %q, want %q", hashOf(c), got, second)
+	}
+
+	checkRestoredBlobs(t, nil, a, b, c)
+}
+
+func TestCloudMediaBackup(t *testing.T) {
+	oldConfig := config
+	t.Cleanup(func() {
+		config = oldConfig
+	})
+	config.S3Config = &S3Config{BucketName: "backups"}
+	srv := httptest.NewServer(newFakeS3())
+	defer srv.Close()
+	provider, err := cloud.NewGenericS3Provider(srv.URL, "access", "secret", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := []byte("first media file"), []byte("second media file")
+	setupTestMediaBackup(t, a, b)
+	ctx := context.Background()
+
+	archiveName, err := exportMedia(ctx, "haven_backup.zip", provider)
+	if err != nil {
+		t.Fatalf("exportMedia: %v", err)
+	}
+	// The manifest and the archive are read from the bucket
+	for _, fileName := range []string{archiveName, "haven_backup.media.json"} {
+		if err := os.Remove(fileName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if archiveName, err := exportMedia(ctx, "haven_backup.zip", provider); err != nil || archiveName != "" {
+		t.Errorf("exportMedia without new blobs = %q, %v, want no archive", archiveName, err)
+	}
+
+	checkRestoredBlobs(t, provider, a, b)
+	if _, err := os.Stat(archiveName); !os.IsNotExist(err) {
+		t.Errorf("downloaded archive left behind: %v", err)
+	}
+}
@@ -2,34 +2,592 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"log"
 	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
+const (
+	blastrQueueStateName  = "blastr_queue"
+	blastrMaxAttempts     = 15
+	blastrInitialBackoff  = 30 * time.Second
+	blastrMaxBackoff      = 6 * time.Hour
+	blastrFailedRetention = 7 * 24 * time.Hour
+	blastrIdleInterval    = time.Hour
+	blastrSaveInterval    = time.Second
+
+	blastrMaxTaggedPubKeys = 100
+	blastrRelayListTimeout = 10 * time.Second
+)
+
+const (
+	deliveryPending = "pending"
+	deliveryFailed  = "failed"
+)
+
+// blastrDelivery tracks the delivery of an outbox event to one relay.
+type blastrDelivery struct {
+	EventID     string          `json:"event_id"`
+	Relay       string          `json:"relay"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	QueuedAt    nostr.Timestamp `json:"queued_at"`
+	NextAttempt nostr.Timestamp `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// blastrQueue holds the outbox events waiting to be delivered to the blastr relays. It is persisted
+// shortly after every change by saveBlastrQueue, so deliveries survive restarts and relays that are
+// down get the events later.
+type blastrQueue struct {
+	mu      sync.Mutex
+	wake    chan struct{}
+	changed chan struct{}
+	saveMu  sync.Mutex // Keeps the writes of the queue in order
+	unsaved bool
+
+	Events     map[string]*nostr.Event    `json:"events"`
+	Deliveries map[string]*blastrDelivery `json:"deliveries"`
+}
+
+var blastr = newBlastrQueue()
+
+func newBlastrQueue() *blastrQueue {
+	return &blastrQueue{
+		wake:       make(chan struct{}, 1),
+		changed:    make(chan struct{}, 1),
+		Events:     make(map[string]*nostr.Event),
+		Deliveries: make(map[string]*blastrDelivery),
+	}
+}
+
+func deliveryKey(eventID, relay string) string {
+	return eventID + " " + relay
+}
+
+// initBlastrQueue loads the deliveries left over from previous runs.
+func initBlastrQueue() {
+	saved := newBlastrQueue()
+	if err := loadState(blastrQueueStateName, saved); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("🚫 error loading blastr queue, starting with an empty one", "error", err)
+		}
+		return
+	}
+
+	blastr.mu.Lock()
+	defer blastr.mu.Unlock()
+	if saved.Events != nil {
+		blastr.Events = saved.Events
+	}
+	if saved.Deliveries != nil {
+		blastr.Deliveries = saved.Deliveries
+	}
+	// Older versions queued NIP-70 protected events too
+	for key, d := range blastr.Deliveries {
+		if ev, ok := blastr.Events[d.EventID]; ok && isProtected(ev) {
+			delete(blastr.Deliveries, key)
+			delete(blastr.Events, d.EventID)
+		}
+	}
+	if len(blastr.Deliveries) > 0 {
+		slog.Info("📬 blastr queue loaded", "deliveries", len(blastr.Deliveries))
+	}
+}
+
+// blast queues the event for delivery to the blastr relays and to the read relays of the pubkeys
+// it tags, unless it is NIP-70 protected or the blastr rules skip it. Deliveries already queued for
+// the same event and relay are not duplicated.
 func blast(ctx context.Context, ev *nostr.Event) {
-	var successCount int
+	if isProtected(ev) {
+		slog.Debug("🔇 not blasting protected event", "id", ev.ID, "kind", ev.Kind)
+		return
+	}
+	if ev.Kind == kindRequestToVanish && !vanishesFromAllRelays(ev) {
+		slog.Debug("🔇 not blasting request to vanish from this relay only", "id", ev.ID)
+		return
+	}
+	if reason := config.BlastrRules.skipReason(ev); reason != "" {
+		slog.Debug("🔇 not blasting event", "id", ev.ID, "kind", ev.Kind, "reason", reason)
+		return
+	}
+	blastr.enqueue(ev, config.BlastrRules.relaysFor(ev.Kind, config.BlastrRelays))
+
+	if config.BlastrMaxTaggedRelays <= 0 || ev.Tags.Find("p") == nil {
+		return
+	}
+	// Fetching relay lists may take a while, so don't hold up the client
+	background.Go(func() {
+		if relays := taggedRelays(ctx, ev); len(relays) > 0 {
+			slog.Debug("📮 delivering event to the relays of tagged pubkeys", "id", ev.ID, "relays", relays)
+			blastr.enqueue(ev, relays)
+		}
+	})
+}
+
+// taggedRelays picks up to BLASTR_MAX_TAGGED_RELAYS read relays from the NIP-65 relay lists of the
+// pubkeys tagged in the event, taking one relay of each pubkey in turn so that every recipient is
+// covered before the cap is reached.
+func taggedRelays(ctx context.Context, ev *nostr.Event) []string {
+	var pubkeys []string
+	for tag := range ev.Tags.FindAll("p") {
+		if len(tag) < 2 || tag[1] == ev.PubKey || !nostr.IsValidPublicKey(tag[1]) {
+			continue
+		}
+		pubkeys = appendUnique(pubkeys, tag[1])
+		if len(pubkeys) == blastrMaxTaggedPubKeys {
+			break
+		}
+	}
+	if len(pubkeys) == 0 {
+		return nil
+	}
+
+	lists := relayListsCache.get(ctx, pubkeys, blastrRelayListTimeout)
+
+	skip := map[string]struct{}{nostr.NormalizeURL("wss://" + config.RelayURL): {}}
 	for _, url := range config.BlastrRelays {
-		timeout := time.Second * time.Duration(config.BlastrTimeoutSeconds)
-		ctx, cancel := context.WithTimeout(ctx, timeout)
-		relay, err := pool.EnsureRelay(url)
-		if err != nil {
-			cancel()
-			slog.Error("⛓️‍💥 error connecting to relay", "relay", url, "error", err)
+		skip[nostr.NormalizeURL(url)] = struct{}{}
+	}
+
+	var relays []string
+	for i := 0; len(relays) < config.BlastrMaxTaggedRelays; i++ {
+		more := false
+		for _, pubkey := range pubkeys {
+			read := lists[pubkey].Read
+			if i >= len(read) {
+				continue
+			}
+			more = true
+			if _, ok := skip[read[i]]; ok {
+				continue
+			}
+			relays = appendUnique(relays, read[i])
+			if len(relays) == config.BlastrMaxTaggedRelays {
+				break
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return relays
+}
+
+func (q *blastrQueue) enqueue(ev *nostr.Event, relays []string) {
+	q.mu.Lock()
+	now := nostr.Now()
+	added := 0
+	for _, url := range relays {
+		key := deliveryKey(ev.ID, url)
+		if _, ok := q.Deliveries[key]; ok {
 			continue
 		}
-		if err := relay.Publish(ctx, *ev); err != nil {
-			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-				slog.Error("🚫 timeout publishing to relay", "relay", url, "timeout", timeout)
+		q.Deliveries[key] = &blastrDelivery{
+			EventID:     ev.ID,
+			Relay:       url,
+			Status:      deliveryPending,
+			QueuedAt:    now,
+			NextAttempt: now,
+		}
+		added++
+	}
+	if added > 0 {
+		q.Events[ev.ID] = ev
+		q.save()
+	}
+	q.mu.Unlock()
+
+	if added > 0 {
+		q.notify()
+	}
+}
+
+// cancel drops the deliveries of the events, which have been deleted.
+func (q *blastrQueue) cancel(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cancelled := false
+	for _, id := range ids {
+		if _, ok := q.Events[id]; !ok {
+			continue
+		}
+		for key, d := range q.Deliveries {
+			if d.EventID == id {
+				delete(q.Deliveries, key)
+			}
+		}
+		delete(q.Events, id)
+		cancelled = true
+	}
+	if cancelled {
+		q.save()
+	}
+}
+
+func (q *blastrQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save schedules the queue to be persisted, without waiting for it. It must be called with the
+// lock held.
+func (q *blastrQueue) save() {
+	q.unsaved = true
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// flush persists the queue if it changed since it was last persisted. Only the encoding of the
+// queue holds the lock, not writing it to disk.
+func (q *blastrQueue) flush() {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	if !q.unsaved {
+		q.mu.Unlock()
+		return
+	}
+	b, err := json.Marshal(q)
+	q.unsaved = false
+	q.mu.Unlock()
+
+	if err == nil {
+		err = saveState(blastrQueueStateName, json.RawMessage(b))
+	}
+	if err != nil {
+		slog.Error("🚫 error saving blastr queue", "error", err)
+		// Try again with the next change
+		q.mu.Lock()
+		q.unsaved = true
+		q.mu.Unlock()
+	}
+}
+
+// saveBlastrQueue persists the queue at most every blastrSaveInterval while it changes, so that
+// queueing an event doesn't wait for the whole queue to be written, until ctx is done. The last
+// changes are persisted on shutdown.
+func saveBlastrQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-blastr.changed:
+		}
+		blastr.flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(blastrSaveInterval):
+		}
+	}
+}
+
+// runBlastrQueue delivers the queued events as they become due, until ctx is done.
+func runBlastrQueue(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-blastr.wake:
+		case <-timer.C:
+		}
+		blastr.deliverDue(ctx)
+		timer.Reset(blastr.untilNextAttempt())
+	}
+}
+
+// blastResult is the outcome of publishing an event to a relay.
+type blastResult struct {
+	outcome string
+	reason  string
+}
+
+const (
+	blastAccepted = "accepted"
+	blastRejected = "rejected"
+	blastTimedOut = "timed_out"
+	blastError    = "error"
+)
+
+// retryable reports whether publishing again may succeed. Relays rejecting an event for any reason
+// other than rate limiting or an internal error won't change their mind.
+func (r blastResult) retryable() bool {
+	if r.outcome != blastRejected {
+		return true
+	}
+	return strings.HasPrefix(r.reason, "rate-limited:") || strings.HasPrefix(r.reason, "error:")
+}
+
+func (r blastResult) String() string {
+	if r.reason == "" {
+		return r.outcome
+	}
+	return r.outcome + ": " + r.reason
+}
+
+// deliverDue attempts every pending delivery whose next attempt is due, publishing to up to
+// BLASTR_WORKERS relays at a time. Deliveries not started within BLASTR_DEADLINE_SECONDS are left
+// for the next round.
+func (q *blastrQueue) deliverDue(ctx context.Context) {
+	if !background.Add() {
+		return
+	}
+	defer background.Done()
+
+	q.prune()
+
+	type attempt struct {
+		key   string
+		relay string
+		event *nostr.Event
+	}
+	var due []attempt
+	q.mu.Lock()
+	now := nostr.Now()
+	for key, d := range q.Deliveries {
+		if d.Status == deliveryPending && d.NextAttempt <= now {
+			due = append(due, attempt{key: key, relay: d.Relay, event: q.Events[d.EventID]})
+		}
+	}
+	q.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Duration(config.BlastrDeadlineSeconds)*time.Second)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]map[string]int)
+		workers = make(chan struct{}, max(config.BlastrWorkers, 1))
+		started = 0
+	)
+	for _, a := range due {
+		select {
+		case workers <- struct{}{}:
+		case <-deadlineCtx.Done():
+		}
+		if deadlineCtx.Err() != nil {
+			break
+		}
+
+		started++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			var result blastResult
+			if a.event == nil {
+				result = blastResult{outcome: blastError, reason: "event missing from the queue"}
 			} else {
-				slog.Error("🚫 error publishing to relay", "relay", url, "error", err)
+				result = publishToRelay(deadlineCtx, a.relay, a.event)
 			}
+			if result.outcome != blastAccepted && ctx.Err() != nil {
+				// Shutting down, the delivery will be attempted again on the next start
+				return
+			}
+			q.complete(a.key, result)
+
+			if a.event == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if results[a.event.ID] == nil {
+				results[a.event.ID] = make(map[string]int)
+			}
+			results[a.event.ID][result.outcome]++
+		}()
+	}
+	wg.Wait()
+
+	if started < len(due) && ctx.Err() == nil {
+		slog.Warn("⏰ blastr deadline reached, postponing the remaining deliveries", "postponed", len(due)-started)
+	}
+	for _, id := range slices.Sorted(maps.Keys(results)) {
+		r := results[id]
+		slog.Info("🔫 blasted event", "id", id, "accepted", r[blastAccepted], "rejected", r[blastRejected],
+			"timed_out", r[blastTimedOut], "errors", r[blastError])
+	}
+}
+
+// complete records the outcome of a delivery attempt, scheduling a retry with exponential backoff
+// when it may succeed later, until the delivery is given up.
+func (q *blastrQueue) complete(key string, result blastResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, ok := q.Deliveries[key]
+	if !ok {
+		return
+	}
+	if result.outcome == blastAccepted {
+		delete(q.Deliveries, key)
+		q.dropUnusedEvent(d.EventID)
+		q.save()
+		return
+	}
+
+	d.Attempts++
+	d.LastError = result.String()
+	switch {
+	case !result.retryable():
+		d.Status = deliveryFailed
+		slog.Warn("🚫 event rejected by relay", "id", d.EventID, "relay", d.Relay, "reason", result.reason)
+	case d.Attempts >= blastrMaxAttempts:
+		d.Status = deliveryFailed
+		slog.Error("🚫 giving up delivering event", "id", d.EventID, "relay", d.Relay, "attempts", d.Attempts, "result", result)
+	default:
+		backoff := min(blastrInitialBackoff<<(d.Attempts-1), blastrMaxBackoff)
+		d.NextAttempt = nostr.Now() + nostr.Timestamp(backoff.Seconds())
+		slog.Warn("⚠️ error delivering event, will retry", "id", d.EventID, "relay", d.Relay, "attempt", d.Attempts, "retry_in", backoff, "result", result)
+	}
+	q.save()
+}
+
+// prune forgets the failed deliveries older than blastrFailedRetention.
+func (q *blastrQueue) prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cutoff := nostr.Now() - nostr.Timestamp(blastrFailedRetention.Seconds())
+	pruned := 0
+	for key, d := range q.Deliveries {
+		if d.Status == deliveryFailed && d.QueuedAt < cutoff {
+			delete(q.Deliveries, key)
+			q.dropUnusedEvent(d.EventID)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		q.save()
+	}
+}
+
+// dropUnusedEvent removes the event once no delivery refers to it. It must be called with the lock held.
+func (q *blastrQueue) dropUnusedEvent(id string) {
+	for _, d := range q.Deliveries {
+		if d.EventID == id {
+			return
+		}
+	}
+	delete(q.Events, id)
+}
+
+// untilNextAttempt returns how long to wait for the next pending delivery to be due.
+func (q *blastrQueue) untilNextAttempt() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wait := blastrIdleInterval
+	now := nostr.Now()
+	for _, d := range q.Deliveries {
+		if d.Status != deliveryPending {
+			continue
+		}
+		wait = min(wait, time.Duration(d.NextAttempt-now)*time.Second)
+	}
+	return max(wait, 0)
+}
+
+func publishToRelay(ctx context.Context, url string, ev *nostr.Event) blastResult {
+	timeout := time.Second * time.Duration(config.BlastrTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	relay, err := pool.EnsureRelay(url)
+	if err != nil {
+		return blastResult{outcome: blastError, reason: fmt.Sprintf("error connecting to relay: %s", err)}
+	}
+	if err := relay.Publish(ctx, *ev); err != nil {
+		if reason, ok := strings.CutPrefix(err.Error(), "msg: "); ok {
+			return blastResult{outcome: blastRejected, reason: reason}
+		}
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return blastResult{outcome: blastTimedOut}
+		}
+		return blastResult{outcome: blastError, reason: err.Error()}
+	}
+	return blastResult{outcome: blastAccepted}
+}
+
+// runBlastrStatus prints the deliveries waiting in the blastr queue.
+func runBlastrStatus() {
+	blastrCmd := flag.NewFlagSet("blastr", flag.ExitOnError)
+	failedOnly := blastrCmd.Bool("failed", false, "Only show the deliveries that were given up")
+	if err := blastrCmd.Parse(os.Args[2:]); err != nil {
+		log.Fatal("🚫 failed to parse blastr command:", err)
+	}
+
+	q := newBlastrQueue()
+	if err := loadState(blastrQueueStateName, q); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal("🚫 error loading blastr queue:", err)
+	}
+
+	deliveries := slices.SortedFunc(maps.Values(q.Deliveries), func(a, b *blastrDelivery) int {
+		if a.QueuedAt != b.QueuedAt {
+			return int(a.QueuedAt - b.QueuedAt)
+		}
+		return strings.Compare(deliveryKey(a.EventID, a.Relay), deliveryKey(b.EventID, b.Relay))
+	})
+
+	pending, failed := 0, 0
+	for _, d := range deliveries {
+		if d.Status == deliveryFailed {
+			failed++
 		} else {
-			successCount++
+			pending++
+		}
+	}
+	fmt.Printf("%d pending and %d failed deliveries\n", pending, failed)
+	if len(deliveries) == 0 {
+		return
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tEVENT\tKIND\tRELAY\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	for _, d := range deliveries {
+		if *failedOnly && d.Status != deliveryFailed {
+			continue
+		}
+		kind := "?"
+		if ev, ok := q.Events[d.EventID]; ok {
+			kind = fmt.Sprint(ev.Kind)
+		}
+		next := "-"
+		if d.Status == deliveryPending {
+			next = d.NextAttempt.Time().Format(time.DateTime)
 		}
-		cancel()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", d.Status, d.EventID, kind, d.Relay, d.Attempts, next, d.LastError)
 	}
-	slog.Info("🔫 blasted event", "id", ev.ID, "relays", successCount)
+	w.Flush()
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BlastrRules decide which of the outbox events are blasted, and to which of the blastr relays.
+type BlastrRules struct {
+	IncludeKinds []KindRange                `json:"include_kinds,omitempty"`
+	ExcludeKinds []KindRange                `json:"exclude_kinds,omitempty"`
+	SkipTags     []string                   `json:"skip_tags,omitempty"`
+	Relays       map[string]BlastrRelayRule `json:"relays,omitempty"` // keyed by relay URL
+}
+
+// BlastrRelayRule restricts the event kinds sent to a single blastr relay.
+type BlastrRelayRule struct {
+	Kinds        []KindRange `json:"kinds,omitempty"`
+	ExcludeKinds []KindRange `json:"exclude_kinds,omitempty"`
+}
+
+// skipReason tells why the event must not be blasted at all, or returns an empty string.
+func (r BlastrRules) skipReason(ev *nostr.Event) string {
+	if len(r.IncludeKinds) > 0 && !kindInRanges(r.IncludeKinds, ev.Kind) && !isDeletionKind(ev.Kind) {
+		return "kind not included"
+	}
+	if kindInRanges(r.ExcludeKinds, ev.Kind) {
+		return "kind excluded"
+	}
+	for _, name := range r.SkipTags {
+		// Tags.Find only matches tags with a value, while a NIP-70 "-" tag has none
+		if slices.ContainsFunc(ev.Tags, func(tag nostr.Tag) bool { return len(tag) > 0 && tag[0] == name }) {
+			return fmt.Sprintf("%q tag", name)
+		}
+	}
+	return ""
+}
+
+// relaysFor returns the relays whose kind restrictions accept the event kind.
+func (r BlastrRules) relaysFor(kind int, relays []string) []string {
+	if len(r.Relays) == 0 {
+		return relays
+	}
+	accepted := make([]string, 0, len(relays))
+	for _, url := range relays {
+		if rule, ok := r.Relays[url]; ok {
+			if len(rule.Kinds) > 0 && !kindInRanges(rule.Kinds, kind) && !isDeletionKind(kind) {
+				continue
+			}
+			if kindInRanges(rule.ExcludeKinds, kind) {
+				continue
+			}
+		}
+		accepted = append(accepted, url)
+	}
+	return accepted
+}
+
+// isDeletionKind reports whether the kind is a deletion or vanish request, which are forwarded
+// to the relays the deleted events may have been blasted to, even if their kinds are not included.
+func isDeletionKind(kind int) bool {
+	return kind == nostr.KindDeletion || kind == kindRequestToVanish
+}
+
+func kindInRanges(ranges []KindRange, kind int) bool {
+	return slices.ContainsFunc(ranges, func(r KindRange) bool { return r.Contains(kind) })
+}
+
+// blastrFile is the extended format of BLASTR_RELAYS_FILE. Relays are either plain URLs or objects
+// with a "url" and kind restrictions.
+type blastrFile struct {
+	Relays       []blastrFileRelay `json:"relays"`
+	IncludeKinds []KindRange       `json:"include_kinds"`
+	ExcludeKinds []KindRange       `json:"exclude_kinds"`
+	SkipTags     []string          `json:"skip_tags"`
+}
+
+type blastrFileRelay struct {
+	URL string `json:"url"`
+	BlastrRelayRule
+}
+
+func (r *blastrFileRelay) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.URL); err == nil {
+		return nil
+	}
+	type plain blastrFileRelay
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// parseBlastrFile reads either a plain array of relays or the extended format, returning the relay
+// URLs and the rules.
+func parseBlastrFile(data []byte) ([]string, BlastrRules, error) {
+	var file blastrFile
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &file.Relays); err != nil {
+			return nil, BlastrRules{}, err
+		}
+	} else if err := json.Unmarshal(trimmed, &file); err != nil {
+		return nil, BlastrRules{}, err
+	}
+
+	rules := BlastrRules{
+		IncludeKinds: file.IncludeKinds,
+		ExcludeKinds: file.ExcludeKinds,
+		SkipTags:     file.SkipTags,
+	}
+	relays := make([]string, 0, len(file.Relays))
+	for _, relay := range file.Relays {
+		url := strings.TrimSpace(relay.URL)
+		if url == "" {
+			return nil, BlastrRules{}, fmt.Errorf("relay without a url")
+		}
+		if !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://") {
+			url = "wss://" + url
+		}
+		relays = append(relays, url)
+		if len(relay.Kinds) > 0 || len(relay.ExcludeKinds) > 0 {
+			if rules.Relays == nil {
+				rules.Relays = make(map[string]BlastrRelayRule)
+			}
+			rules.Relays[url] = relay.BlastrRelayRule
+		}
+	}
+	return relays, rules, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/barrydeen/haven/internal/cloud"
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+const (
+	blobStorageLocal = "local"
+	blobStorageS3    = "s3"
+)
+
+// BlobStorage keeps the bytes of the Blossom blobs, which are named after their SHA-256 hash. The
+// Blossom index in the database keeps track of who owns them.
+type BlobStorage interface {
+	Name() string
+	Store(ctx context.Context, sha256 string, body io.Reader, size int64, contentType string) error
+	// Load fails with an error wrapping os.ErrNotExist if the blob isn't stored.
+	Load(ctx context.Context, sha256 string) (io.ReadSeekCloser, error)
+	Exists(ctx context.Context, sha256 string) (bool, error)
+	Delete(ctx context.Context, sha256 string) error
+	// List calls fn with the hash of every stored blob.
+	List(ctx context.Context, fn func(sha256 string) error) error
+}
+
+// blobStorage is where the Blossom server keeps its blobs, set by BLOSSOM_STORAGE.
+var blobStorage BlobStorage
+
+func newBlobStorage(name string) (BlobStorage, error) {
+	switch name {
+	case blobStorageLocal:
+		storage := localBlobStorage{path: config.BlossomPath}
+		if err := storage.migrateLayout(); err != nil {
+			return nil, fmt.Errorf("failed to migrate the blob folder: %w", err)
+		}
+		return storage, nil
+	case blobStorageS3:
+		s3Config := config.BlossomS3Config
+		if s3Config == nil {
+			return nil, errors.New("BLOSSOM_S3_BUCKET_NAME is not set")
+		}
+		provider, err := cloud.NewGenericS3Provider(s3Config.Endpoint, s3Config.AccessKeyID, s3Config.SecretKey, s3Config.Region)
+		if err != nil {
+			return nil, err
+		}
+		return s3BlobStorage{storage: provider, bucket: s3Config.BucketName}, nil
+	default:
+		return nil, fmt.Errorf("unknown blob storage %q, expected %q or %q", name, blobStorageLocal, blobStorageS3)
+	}
+}
+
+// s3BlobStorage keeps the blobs in an S3 compatible bucket.
+type s3BlobStorage struct {
+	storage cloud.Storage
+	bucket  string
+}
+
+func (s s3BlobStorage) Name() string {
+	return blobStorageS3
+}
+
+func (s s3BlobStorage) Store(ctx context.Context, sha256 string, body io.Reader, size int64, contentType string) error {
+	return s.storage.Upload(ctx, s.bucket, sha256, body, size, contentType)
+}
+
+func (s s3BlobStorage) Load(ctx context.Context, sha256 string) (io.ReadSeekCloser, error) {
+	return s.storage.Open(ctx, s.bucket, sha256)
+}
+
+func (s s3BlobStorage) Exists(ctx context.Context, sha256 string) (bool, error) {
+	return s.storage.Exists(ctx, s.bucket, sha256)
+}
+
+func (s s3BlobStorage) Delete(ctx context.Context, sha256 string) error {
+	return s.storage.Delete(ctx, s.bucket, sha256)
+}
+
+func (s s3BlobStorage) List(ctx context.Context, fn func(sha256 string) error) error {
+	return s.storage.List(ctx, s.bucket, "", func(objectName string) error {
+		if !isBlobHash(objectName) {
+			return nil
+		}
+		return fn(objectName)
+	})
+}
+
+func isBlobHash(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// blobSize returns the size of the blob, leaving it at the start.
+func blobSize(blob io.ReadSeeker) (int64, error) {
+	size, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = blob.Seek(0, io.SeekStart)
+	return size, err
+}
+
+func runBlossom(ctx context.Context) {
+	if len(os.Args) < 3 {
+		printBlossomHelp()
+		os.Exit(1)
+	}
+
+	switch os.Args[2] {
+	case "migrate":
+		runBlossomMigrate(ctx)
+	case "verify":
+		runBlossomVerify(ctx)
+	case "gc":
+		runBlossomGC(ctx)
+	case "help", "-h", "--help":
+		printBlossomHelp()
+	default:
+		fmt.Printf("unknown blossom command %q\n\n", os.Args[2])
+		printBlossomHelp()
+		os.Exit(1)
+	}
+}
+
+func printBlossomHelp() {
+	fmt.Println("usage: haven blossom [command]")
+	fmt.Println()
+	fmt.Println("commands:")
+	fmt.Println("  migrate - copy the blobs from one storage to another")
+	fmt.Println("  verify  - check the blobs are intact and match the Blossom index")
+	fmt.Println("  gc      - delete the blobs no one owns and the index entries of missing blobs")
+}
+
+func runBlossomMigrate(ctx context.Context) {
+	migrateCmd := flag.NewFlagSet("blossom migrate", flag.ExitOnError)
+	from := migrateCmd.String("from", blobStorageLocal, "Storage to copy the blobs from (local or s3)")
+	to := migrateCmd.String("to", blobStorageS3, "Storage to copy the blobs to (local or s3)")
+	deleteSource := migrateCmd.Bool("delete", false, "Delete the blobs from the source storage once copied")
+	if err := migrateCmd.Parse(os.Args[3:]); err != nil {
+		log.Fatal("🚫 failed to parse blossom migrate command:", err)
+	}
+
+	if *from == *to {
+		log.Fatal("🚫 the source and destination storages are the same")
+	}
+	src, err := newBlobStorage(*from)
+	if err != nil {
+		log.Fatalf("🚫 error setting up %s blob storage: %v", *from, err)
+	}
+	dst, err := newBlobStorage(*to)
+	if err != nil {
+		log.Fatalf("🚫 error setting up %s blob storage: %v", *to, err)
+	}
+
+	// The Blossom index has the types of the blobs
+	initDBs()
+	defer closeDBs()
+
+	log.Printf("📦 migrating blobs from %s to %s storage\n", src.Name(), dst.Name())
+	copied, skipped, failed := 0, 0, 0
+	err = src.List(ctx, func(sha256 string) error {
+		exists, err := dst.Exists(ctx, sha256)
+		if err != nil {
+			return err
+		}
+		if exists {
+			skipped++
+		} else if err := copyBlob(ctx, src, dst, sha256, indexedBlobType(ctx, sha256)); err != nil {
+			log.Printf("🚫 error copying blob %s: %v\n", sha256, err)
+			failed++
+			return nil
+		} else {
+			copied++
+		}
+
+		if *deleteSource {
+			if err := src.Delete(ctx, sha256); err != nil {
+				log.Printf("🚫 error deleting blob %s from %s storage: %v\n", sha256, src.Name(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("🚫 error listing blobs:", err)
+	}
+
+	log.Printf("✅ migrated blobs: %d copied, %d already there, %d failed\n", copied, skipped, failed)
+	if failed > 0 {
+		closeDBs()
+		os.Exit(1)
+	}
+}
+
+// indexedBlobType returns the type of a blob in the Blossom index, falling back to
+// application/octet-stream for blobs that aren't indexed.
+func indexedBlobType(ctx context.Context, hash string) string {
+	bd, err := blossom.EventStoreBlobIndexWrapper{Store: blossomDB}.Get(ctx, hash)
+	if err != nil || bd == nil || bd.Type == "" {
+		return "application/octet-stream"
+	}
+	return bd.Type
+}
+
+// copyBlob copies a blob between storages, checking its content still matches its hash.
+func copyBlob(ctx context.Context, src, dst BlobStorage, hash string, contentType string) error {
+	blob, err := src.Load(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	size, err := blobSize(blob)
+	if err != nil {
+		return err
+	}
+	return storeVerifiedBlob(ctx, dst, hash, blob, size, contentType)
+}
+
+// storeVerifiedBlob stores a blob that isn't stored yet, and deletes it again if it can't be read
+// whole or its content doesn't match its hash.
+func storeVerifiedBlob(ctx context.Context, storage BlobStorage, hash string, body io.Reader, size int64, contentType string) error {
+	h := sha256.New()
+	err := storage.Store(ctx, hash, io.TeeReader(body, h), size, contentType)
+	if actual := hex.EncodeToString(h.Sum(nil)); err == nil && actual != hash {
+		err = fmt.Errorf("content hashes to %s", actual)
+	}
+	if err != nil {
+		if err := storage.Delete(ctx, hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("🚫 error deleting corrupted blob", "sha256", hash, "storage", storage.Name(), "error", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// initBlobStorage sets up the blob storage selected by BLOSSOM_STORAGE.
+func initBlobStorage() {
+	storage, err := newBlobStorage(config.BlossomStorage)
+	if err != nil {
+		log.Fatal("🚫 error setting up blob storage:", err)
+	}
+	blobStorage = storage
+
+	// Uploads are staged in the Blossom folder whatever the storage
+	if err := removeStaleUploads(blobUploadPath()); err != nil {
+		slog.Error("🚫 error deleting interrupted uploads", "error", err)
+	}
+}
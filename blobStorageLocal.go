@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// blobTmpFolder is the subfolder of BLOSSOM_PATH where blobs are written before being moved into
+	// place, which is on the same file system so that the move is atomic.
+	blobTmpFolder = "tmp"
+	// staleUploadAge is how old a temporary file must be to be considered left over by an
+	// interrupted upload.
+	staleUploadAge = time.Hour
+)
+
+// localBlobStorage keeps the blobs in a folder of the file system. Each blob is in a subfolder named
+// after the first two pairs of characters of its hash, such as ab/cd/abcd..., so that no folder
+// holds too many files.
+type localBlobStorage struct {
+	path string
+}
+
+func (s localBlobStorage) Name() string {
+	return blobStorageLocal
+}
+
+func (s localBlobStorage) blobPath(hash string) (string, error) {
+	if !isBlobHash(hash) {
+		return "", fmt.Errorf("invalid blob hash %q: %w", hash, os.ErrNotExist)
+	}
+	return filepath.Join(s.path, hash[0:2], hash[2:4], hash), nil
+}
+
+func (s localBlobStorage) tmpPath() string {
+	return filepath.Join(s.path, blobTmpFolder)
+}
+
+// Store writes the blob to a temporary file and only moves it into place once it is complete, its
+// content matches its hash and it is synced to disk, so a blob is never served half written.
+func (s localBlobStorage) Store(_ context.Context, hash string, body io.Reader, _ int64, _ string) error {
+	path, err := s.blobPath(hash)
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(s.tmpPath(), 0755); err != nil {
+		return err
+	}
+	tmp, err := afero.TempFile(fs, s.tmpPath(), hash+"-*")
+	if err != nil {
+		return err
+	}
+	// Some file systems, such as afero's in-memory one, rename the open file too
+	tmpName := tmp.Name()
+	defer func() {
+		// Only left there if something failed
+		if err := fs.Remove(tmpName); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("🚫 error deleting temporary blob file", "file", tmpName, "error", err)
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		tmp.Close()
+		return fmt.Errorf("content hashes to %s", actual)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpName, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func (s localBlobStorage) Load(_ context.Context, hash string) (io.ReadSeekCloser, error) {
+	path, err := s.blobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Open(path)
+}
+
+func (s localBlobStorage) Exists(_ context.Context, hash string) (bool, error) {
+	path, err := s.blobPath(hash)
+	if err != nil {
+		return false, nil
+	}
+	return afero.Exists(fs, path)
+}
+
+func (s localBlobStorage) Delete(_ context.Context, hash string) error {
+	path, err := s.blobPath(hash)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(path)
+}
+
+func (s localBlobStorage) List(_ context.Context, fn func(sha256 string) error) error {
+	return afero.Walk(fs, s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == s.tmpPath() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if blobPath, err := s.blobPath(info.Name()); err != nil || blobPath != filepath.Clean(path) {
+			return nil
+		}
+		return fn(info.Name())
+	})
+}
+
+// migrateLayout moves the blobs that older versions of Haven kept directly in the Blossom folder to
+// their subfolders.
+func (s localBlobStorage) migrateLayout() error {
+	// BLOSSOM_PATH used to be a prefix of the blob file names rather than a folder, so blobs of a path
+	// without a trailing slash, like "blossom", were named "blossom<hash>" in the parent folder
+	dir, prefix := filepath.Clean(s.path), ""
+	if !strings.HasSuffix(s.path, "/") {
+		dir, prefix = filepath.Dir(dir), filepath.Base(dir)
+	}
+	moved := 0
+	for _, folder := range []struct{ dir, prefix string }{{s.path, ""}, {dir, prefix}} {
+		files, err := afero.ReadDir(fs, folder.dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, file := range files {
+			hash, ok := strings.CutPrefix(file.Name(), folder.prefix)
+			if file.IsDir() || !ok || !isBlobHash(hash) {
+				continue
+			}
+			path, _ := s.blobPath(hash)
+			if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := fs.Rename(filepath.Join(folder.dir, file.Name()), path); err != nil {
+				return err
+			}
+			moved++
+		}
+	}
+	if moved > 0 {
+		slog.Info("📦 moved blobs to the new Blossom folder layout", "count", moved)
+	}
+	return nil
+}
+
+// removeStaleUploads deletes the temporary files left in the folder by interrupted uploads.
+func removeStaleUploads(dir string) error {
+	files, err := afero.ReadDir(fs, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if time.Since(file.ModTime()) < staleUploadAge {
+			continue
+		}
+		if err := fs.Remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes sure a file moved into the folder stays there after a crash. Not every file system
+// supports it, so errors are ignored.
+func syncDir(path string) {
+	if dir, err := fs.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
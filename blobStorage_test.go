@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barrydeen/haven/internal/cloud"
+	"github.com/spf13/afero"
+)
+
+func TestLocalBlobStorage(t *testing.T) {
+	setupTestBlobStorage(t)
+	testBlobStorage(t, blobStorage)
+
+	// Nothing is left behind by a failed store
+	if files, _ := afero.ReadDir(fs, "blossom/tmp"); len(files) > 0 {
+		t.Errorf("%d temporary files left behind", len(files))
+	}
+}
+
+func TestS3BlobStorage(t *testing.T) {
+	srv := httptest.NewServer(newFakeS3())
+	defer srv.Close()
+
+	provider, err := cloud.NewGenericS3Provider(srv.URL, "access", "secret", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStorage(t, s3BlobStorage{storage: provider, bucket: "blobs"})
+}
+
+func TestCopyBlob(t *testing.T) {
+	setupTestBlobStorage(t)
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	provider, err := cloud.NewGenericS3Provider(srv.URL, "access", "secret", "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := s3BlobStorage{storage: provider, bucket: "blobs"}
+
+	ctx := context.Background()
+	data := []byte("migrated media file")
+	hash := hashOf(data)
+	if err := blobStorage.Store(ctx, hash, bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyBlob(ctx, blobStorage, s3, hash, "text/plain"); err != nil {
+		t.Fatalf("copyBlob: %v", err)
+	}
+
+	blob, err := s3.Load(ctx, hash)
+	if err != nil {
+		t.Fatalf("Load from the destination: %v", err)
+	}
+	defer blob.Close()
+	if got, err := io.ReadAll(blob); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("copied blob = %q, %v, want %q", got, err, data)
+	}
+	if got := fake.types["blobs/"+hash]; got != "text/plain" {
+		t.Errorf("copied blob type = %q, want text/plain", got)
+	}
+}
+
+// testBlobStorage stores, reads, lists and deletes blobs in the storage, which must be empty.
+func testBlobStorage(t *testing.T, storage BlobStorage) {
+	t.Helper()
+	ctx := context.Background()
+	data := []byte("some media file content")
+	hash := hashOf(data)
+
+	if exists, err := storage.Exists(ctx, hash); err != nil || exists {
+		t.Fatalf("Exists before Store = %v, %v, want false", exists, err)
+	}
+	if _, err := storage.Load(ctx, hash); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load before Store error = %v, want os.ErrNotExist", err)
+	}
+
+	if err := storage.Store(ctx, hash, bytes.NewReader(data), int64(len(data)), "text/plain"); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if exists, err := storage.Exists(ctx, hash); err != nil || !exists {
+		t.Fatalf("Exists after Store = %v, %v, want true", exists, err)
+	}
+
+	blob, err := storage.Load(ctx, hash)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if size, err := blobSize(blob); err != nil || size != int64(len(data)) {
+		t.Errorf("blobSize = %d, %v, want %d", size, err, len(data))
+	}
+	if _, err := blob.Seek(5, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	got, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || !bytes.Equal(got, data[5:]) {
+		t.Errorf("read after Seek = %q, %v, want %q", got, err, data[5:])
+	}
+
+	var listed []string
+	if err := storage.List(ctx, func(sha256 string) error {
+		listed = append(listed, sha256)
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !slices.Equal(listed, []string{hash}) {
+		t.Errorf("List = %v, want [%s]", listed, hash)
+	}
+
+	// Local storages refuse content that doesn't match the hash, storeVerifiedBlob deletes it from
+	// the others
+	other := []byte("other content")
+	if err := storeVerifiedBlob(ctx, storage, hashOf(data[1:]), bytes.NewReader(other), int64(len(other)), "text/plain"); err == nil {
+		t.Error("storeVerifiedBlob with a wrong hash succeeded")
+	}
+	if exists, _ := storage.Exists(ctx, hashOf(data[1:])); exists {
+		t.Error("blob with a wrong hash was kept")
+	}
+
+	if err := storage.Delete(ctx, hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if exists, err := storage.Exists(ctx, hash); err != nil || exists {
+		t.Errorf("Exists after Delete = %v, %v, want false", exists, err)
+	}
+}
+
+// fakeS3 is an in-memory stand-in for an S3 compatible server, supporting just what the blob
+// storage uses. Signatures are not checked.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+// fakeS3Modified is the modification time of every object, S3 clients expect one.
+var fakeS3Modified = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), types: make(map[string]string)}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		switch {
+		case r.URL.Query().Has("location"):
+			fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		case r.Method == http.MethodGet:
+			s.list(w, bucket, r.URL.Query().Get("prefix"))
+		}
+		return
+	}
+
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		var data []byte
+		var err error
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = decodeAWSChunked(r.Body)
+		} else {
+			data, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[name] = data
+		s.types[name] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"`+hashOf(data)+`"`)
+	case http.MethodDelete:
+		delete(s.objects, name)
+		delete(s.types, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[name]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"`+hashOf(data)+`"`)
+		http.ServeContent(w, r, "", fakeS3Modified, bytes.NewReader(data))
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	var keys []string
+	for name := range s.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`,
+		bucket, prefix, len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+			key, fakeS3Modified.Format(time.RFC3339), len(s.objects[bucket+"/"+key]))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+// decodeAWSChunked reads a body sent with the aws-chunked encoding, ignoring the chunk signatures.
+func decodeAWSChunked(body io.Reader) ([]byte, error) {
+	r := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, r, size); err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blobIndexGracePeriod is how long a blob can be in the Blossom index without being stored, as
+// uploads are indexed before they are stored.
+const blobIndexGracePeriod = time.Hour
+
+// blobCheck is what comparing the stored blobs to the Blossom index found.
+type blobCheck struct {
+	stored    int
+	verified  bool
+	corrupted []string                  // stored blobs whose content doesn't match their hash
+	unindexed []string                  // stored blobs no one owns
+	missing   map[string][]*nostr.Event // index entries of blobs that aren't stored
+	index     map[string][]*nostr.Event
+}
+
+func (c *blobCheck) ok() bool {
+	return len(c.corrupted) == 0 && len(c.unindexed) == 0 && len(c.missing) == 0
+}
+
+// checkBlobs compares the stored blobs to the Blossom index. If verify is set, the indexed blobs
+// are also read back to check their content still matches their hash.
+func checkBlobs(ctx context.Context, verify bool) (*blobCheck, error) {
+	// List the blobs before reading the index: as uploads are indexed first, every listed blob that
+	// is still owned by someone will be in the index
+	var hashes []string
+	err := blobStorage.List(ctx, func(sha256 string) error {
+		hashes = append(hashes, sha256)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	index := make(map[string][]*nostr.Event)
+	err = scanEvents(ctx, blossomDB, nostr.Filter{Kinds: []int{24242}}, func(event *nostr.Event) {
+		if x := event.Tags.Find("x"); x != nil {
+			index[x[1]] = append(index[x[1]], event)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the blob index: %w", err)
+	}
+
+	check := &blobCheck{
+		stored:   len(hashes),
+		verified: verify,
+		missing:  make(map[string][]*nostr.Event),
+		index:    index,
+	}
+	stored := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		stored[hash] = struct{}{}
+		if _, ok := index[hash]; !ok {
+			check.unindexed = append(check.unindexed, hash)
+			continue
+		}
+		if !verify {
+			continue
+		}
+		intact, err := verifyBlob(ctx, hash)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since it was listed
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read blob %s: %w", hash, err)
+		}
+		if !intact {
+			check.corrupted = append(check.corrupted, hash)
+		}
+	}
+
+	indexedBefore := nostr.Timestamp(time.Now().Add(-blobIndexGracePeriod).Unix())
+	for hash, entries := range index {
+		if _, ok := stored[hash]; ok {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.CreatedAt < indexedBefore {
+				check.missing[hash] = append(check.missing[hash], entry)
+			}
+		}
+	}
+	return check, nil
+}
+
+// verifyBlob reports whether the content of the stored blob still hashes to its name.
+func verifyBlob(ctx context.Context, hash string) (bool, error) {
+	blob, err := blobStorage.Load(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, blob); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == hash, nil
+}
+
+// collectBlobGarbage deletes the stored blobs that aren't in the Blossom index and the index
+// entries of the blobs that aren't stored. Corrupted blobs are deleted along with their index
+// entries, so they can be uploaded again, only if deleteCorrupted is set.
+func collectBlobGarbage(ctx context.Context, check *blobCheck, deleteCorrupted bool) (blobs int, entries int) {
+	deleteEntries := func(hash string, events []*nostr.Event) {
+		for _, event := range events {
+			if err := blossomDB.DeleteEvent(ctx, event); err != nil {
+				slog.Error("🚫 error deleting blob index entry", "sha256", hash, "pubkey", event.PubKey, "error", err)
+				continue
+			}
+			blobUsages.remove(event.PubKey, indexEntrySize(event))
+			entries++
+		}
+	}
+	deleteBlob := func(hash string) {
+		if err := blobStorage.Delete(ctx, hash); err != nil {
+			slog.Error("🚫 error deleting blob", "sha256", hash, "error", err)
+			return
+		}
+		blobs++
+	}
+
+	for _, hash := range check.unindexed {
+		deleteBlob(hash)
+	}
+	for hash, events := range check.missing {
+		deleteEntries(hash, events)
+	}
+	if deleteCorrupted {
+		for _, hash := range check.corrupted {
+			deleteBlob(hash)
+			deleteEntries(hash, check.index[hash])
+		}
+	}
+	return blobs, entries
+}
+
+// collectBlossomGarbage checks and cleans up the Blossom storage every interval, until ctx is done.
+// Corrupted blobs are only reported, as they may be restored from a backup.
+func collectBlossomGarbage(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("🧽 Blossom garbage collection is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		check, err := checkBlobs(ctx, true)
+		if err != nil {
+			slog.Error("🚫 error checking Blossom blobs", "error", err)
+			continue
+		}
+		for _, hash := range check.corrupted {
+			slog.Error("🚫 corrupted blob, run 'haven blossom gc --delete-corrupted' or restore it from a backup", "sha256", hash)
+		}
+		if blobs, entries := collectBlobGarbage(ctx, check, false); blobs > 0 || entries > 0 {
+			slog.Info("🧽 collected Blossom garbage", "blobs", blobs, "index_entries", entries)
+		}
+	}
+}
+
+func runBlossomVerify(ctx context.Context) {
+	verifyCmd := flag.NewFlagSet("blossom verify", flag.ExitOnError)
+	if err := verifyCmd.Parse(os.Args[3:]); err != nil {
+		log.Fatal("🚫 failed to parse blossom verify command:", err)
+	}
+
+	initDBs()
+	defer closeDBs()
+	check := checkBlossomStorage(ctx, true)
+	printBlobCheck(check)
+	if !check.ok() {
+		os.Exit(1)
+	}
+}
+
+func runBlossomGC(ctx context.Context) {
+	gcCmd := flag.NewFlagSet("blossom gc", flag.ExitOnError)
+	dryRun := gcCmd.Bool("dry-run", false, "Only show what would be deleted")
+	deleteCorrupted := gcCmd.Bool("delete-corrupted", false, "Also check the content of the blobs, and delete the corrupted ones")
+	if err := gcCmd.Parse(os.Args[3:]); err != nil {
+		log.Fatal("🚫 failed to parse blossom gc command:", err)
+	}
+
+	initDBs()
+	defer closeDBs()
+	check := checkBlossomStorage(ctx, *deleteCorrupted)
+	printBlobCheck(check)
+	if *dryRun {
+		return
+	}
+	blobs, entries := collectBlobGarbage(ctx, check, *deleteCorrupted)
+	log.Printf("🧽 deleted %d blobs and %d index entries\n", blobs, entries)
+}
+
+func checkBlossomStorage(ctx context.Context, verify bool) *blobCheck {
+	initBlobStorage()
+	check, err := checkBlobs(ctx, verify)
+	if err != nil {
+		log.Fatal("🚫 ", err)
+	}
+	return check
+}
+
+func printBlobCheck(check *blobCheck) {
+	for _, hash := range check.corrupted {
+		fmt.Printf("corrupted: %s\n", hash)
+	}
+	for _, hash := range check.unindexed {
+		fmt.Printf("not indexed: %s\n", hash)
+	}
+	for hash, entries := range check.missing {
+		fmt.Printf("missing: %s (owned by %d pubkeys)\n", hash, len(entries))
+	}
+
+	fmt.Printf("%d blobs stored", check.stored)
+	if check.verified {
+		fmt.Printf(", %d corrupted", len(check.corrupted))
+	}
+	fmt.Printf(", %d not indexed, %d indexed but missing\n", len(check.unindexed), len(check.missing))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// handleGetBlob serves the blobs like the Blossom server does, but with a valid ETag, which browsers
+// need to send conditional range requests when seeking in videos. Range requests are served
+// straight from the blob storage, without reading the rest of the blob. Other paths are passed to
+// next.
+func handleGetBlob(bl *blossom.BlossomServer, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, ext, _ := strings.Cut(r.PathValue("blob"), ".")
+		if r.Method != http.MethodGet || !isBlobHash(hash) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "" {
+			auth, code, err := readBlossomAuthorization(r, "get")
+			if err != nil {
+				blossomError(w, err.Error(), code)
+				return
+			}
+			if auth.Tags.FindWithValue("x", hash) == nil && auth.Tags.FindWithValue("server", bl.ServiceURL) == nil {
+				blossomError(w, "invalid \"Authorization\" event \"x\" or \"server\" tag", 403)
+				return
+			}
+		}
+
+		blob, err := blobStorage.Load(r.Context(), hash)
+		if errors.Is(err, os.ErrNotExist) {
+			blossomError(w, "file not found", 404)
+			return
+		} else if err != nil {
+			slog.Error("🚫 error loading blob", "sha256", hash, "error", err)
+			blossomError(w, "failed to load blob", 500)
+			return
+		}
+		defer blob.Close()
+
+		// The Unix epoch tells http.ServeContent the modification time is unknown
+		modified := time.Unix(0, 0)
+		if bd, err := bl.Store.Get(r.Context(), hash); err == nil && bd != nil {
+			modified = bd.Uploaded.Time()
+			w.Header().Set("Content-Type", bd.Type)
+		}
+		name := hash
+		if ext != "" {
+			name += "." + ext
+		}
+		w.Header().Set("ETag", `"`+hash+`"`)
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+		http.ServeContent(w, r, name, modified, blob)
+	}
+}
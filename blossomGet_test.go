@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetBlobRange(t *testing.T) {
+	bl, _ := setupTestBlossom(t)
+	blob := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	hash := hashOf(blob)
+	if _, err := keepBlob(t.Context(), bl, config.OwnerPubKey, hash, bytes.NewReader(blob), int64(len(blob)), ".mp4"); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{blob}", handleGetBlob(bl, http.NotFoundHandler()))
+	etag := `"` + hash + `"`
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"whole blob", nil, http.StatusOK, string(blob), ""},
+		{"range", map[string]string{"Range": "bytes=10-15"}, http.StatusPartialContent, "abcdef", "bytes 10-15/36"},
+		{"suffix range", map[string]string{"Range": "bytes=-4"}, http.StatusPartialContent, "wxyz", "bytes 32-35/36"},
+		{"range matching the ETag", map[string]string{"Range": "bytes=0-1", "If-Range": etag}, http.StatusPartialContent, "01", "bytes 0-1/36"},
+		{"range of another version", map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, http.StatusOK, string(blob), ""},
+		{"unchanged", map[string]string{"If-None-Match": etag}, http.StatusNotModified, "", ""},
+		{"range past the end", map[string]string{"Range": "bytes=100-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */36"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+hash+".mp4", nil)
+			for key, value := range test.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			// http.ServeContent drops the ETag from errors
+			if got := w.Header().Get("ETag"); got != etag && w.Code < 400 {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+			if test.status == http.StatusOK || test.status == http.StatusPartialContent {
+				if got, _ := io.ReadAll(w.Body); string(got) != test.body {
+					t.Errorf("body = %q, want %q", got, test.body)
+				}
+				if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+					t.Errorf("Content-Type = %s, want video/mp4", got)
+				}
+			}
+		})
+	}
+}
+
+func TestGetBlobMissing(t *testing.T) {
+	bl, _ := setupTestBlossom(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{blob}", handleGetBlob(bl, http.NotFoundHandler()))
+
+	r := httptest.NewRequest(http.MethodGet, "/"+hashOf([]byte("missing")), nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxMediaPixels is the largest image, in pixels, the media endpoint decodes.
+const maxMediaPixels = 100_000_000
+
+// BlossomMedia configures the BUD-05 media endpoint.
+type BlossomMedia struct {
+	Enabled           bool  `json:"enabled"`
+	MaxDimension      int   `json:"max_dimension"`
+	VariantDimensions []int `json:"variant_dimensions"`
+	JPEGQuality       int   `json:"jpeg_quality"`
+}
+
+func getBlossomMedia() BlossomMedia {
+	return BlossomMedia{
+		Enabled:           getEnvBool("BLOSSOM_MEDIA_ENABLED", false),
+		MaxDimension:      getEnvInt("BLOSSOM_MEDIA_MAX_DIMENSION", 2048),
+		VariantDimensions: getEnvIntList("BLOSSOM_MEDIA_VARIANT_DIMENSIONS", []int{640}),
+		JPEGQuality:       getEnvInt("BLOSSOM_MEDIA_JPEG_QUALITY", 85),
+	}
+}
+
+// mediaDescriptor is the blob descriptor of a processed media file, with the NIP-94 tags clients
+// can use to describe it and its resized variants.
+type mediaDescriptor struct {
+	blossom.BlobDescriptor
+	Dim      string            `json:"dim,omitempty"`
+	NIP94    [][]string        `json:"nip94,omitempty"`
+	Variants []mediaDescriptor `json:"variants,omitempty"`
+}
+
+// handleMediaCheck tells clients whether they can upload a media file, like HEAD /upload.
+func handleMediaCheck(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, code, err := readBlossomAuthorization(r, "media", "upload")
+		if err != nil {
+			blossomError(w, err.Error(), code)
+			return
+		}
+		size, _ := strconv.Atoi(r.Header.Get("X-Content-Length"))
+		ext := blobExtension(nil, r.Header.Get("X-Content-Type"), "")
+		if rejected, reason, code := rejectUpload(r.Context(), bl, auth, size, ext); rejected {
+			blossomError(w, reason, code)
+		}
+	}
+}
+
+// handleMedia implements BUD-05: images are stripped of their metadata, such as EXIF location
+// data, scaled down to the maximum dimension and stored along with smaller variants. Other media
+// files are stored as they are.
+func handleMedia(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, code, err := readBlossomAuthorization(r, "media", "upload")
+		if err != nil {
+			blossomError(w, err.Error(), code)
+			return
+		}
+		blob, ext := receiveBlob(w, r, bl, auth)
+		if blob == nil {
+			return
+		}
+		defer blob.Close()
+
+		images, err := processStagedImage(blob, config.BlossomMedia)
+		if err != nil {
+			blossomError(w, err.Error(), 400)
+			return
+		}
+		if images == nil {
+			bd, err := keepStagedBlob(r.Context(), bl, auth.PubKey, blob, ext)
+			if err != nil {
+				blossomError(w, err.Error(), 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mediaDescriptor{BlobDescriptor: bd})
+			return
+		}
+
+		descriptors := make([]mediaDescriptor, 0, len(images))
+		for _, img := range images {
+			hash := sha256.Sum256(img.body)
+			bd, err := keepBlob(r.Context(), bl, auth.PubKey, hex.EncodeToString(hash[:]), bytes.NewReader(img.body), int64(len(img.body)), img.ext)
+			if err != nil {
+				blossomError(w, err.Error(), 500)
+				return
+			}
+			descriptors = append(descriptors, mediaDescriptor{
+				BlobDescriptor: bd,
+				Dim:            fmt.Sprintf("%dx%d", img.width, img.height),
+			})
+		}
+
+		media := descriptors[0]
+		media.Variants = descriptors[1:]
+		media.NIP94 = [][]string{
+			{"url", media.URL},
+			{"m", media.Type},
+			{"x", media.SHA256},
+			{"ox", blob.sha256},
+			{"size", strconv.Itoa(media.Size)},
+			{"dim", media.Dim},
+		}
+		if len(media.Variants) > 0 {
+			media.NIP94 = append(media.NIP94, []string{"thumb", media.Variants[len(media.Variants)-1].URL})
+		}
+		slog.Info("🖼️ processed media", "sha256", media.SHA256, "original", blob.sha256, "pubkey", auth.PubKey,
+			"size", media.Size, "original_size", blob.size, "variants", len(media.Variants))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(media)
+	}
+}
+
+// processedImage is an image re-encoded by the media endpoint.
+type processedImage struct {
+	body          []byte
+	ext           string
+	width, height int
+}
+
+// processStagedImage reads the staged blob into memory to process it, if it is an image.
+func processStagedImage(blob *stagedBlob, options BlossomMedia) ([]processedImage, error) {
+	body, err := blob.rewind()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := image.DecodeConfig(body); err != nil {
+		return nil, nil
+	}
+	if body, err = blob.rewind(); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return processImage(data, options)
+}
+
+// processImage decodes a still image, applies its EXIF orientation and re-encodes it at the maximum
+// dimension and at each smaller variant dimension, which leaves out all its metadata. It returns nil
+// if the body isn't a still image it can process.
+func processImage(body []byte, options BlossomMedia) ([]processedImage, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil
+	}
+	if cfg.Width*cfg.Height > maxMediaPixels {
+		return nil, fmt.Errorf("image is too large to process: %dx%d", cfg.Width, cfg.Height)
+	}
+	if format == "gif" {
+		// Re-encoding would lose the animation, and GIFs don't have EXIF metadata anyway
+		if anim, err := gif.DecodeAll(bytes.NewReader(body)); err != nil || len(anim.Image) > 1 {
+			return nil, nil
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(body))
+	}
+
+	// JPEGs stay JPEGs and other images become PNGs, unless they have no transparency
+	encode := func(img image.Image) ([]byte, string, error) {
+		var buf bytes.Buffer
+		if opaque, ok := img.(interface{ Opaque() bool }); format == "jpeg" || (format != "png" && ok && opaque.Opaque()) {
+			err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: options.JPEGQuality})
+			return buf.Bytes(), ".jpg", err
+		}
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), ".png", err
+	}
+
+	longest := max(img.Bounds().Dx(), img.Bounds().Dy())
+	dimensions := []int{longest}
+	if options.MaxDimension > 0 && options.MaxDimension < longest {
+		dimensions[0] = options.MaxDimension
+	}
+	variants := slices.Clone(options.VariantDimensions)
+	slices.Sort(variants)
+	slices.Reverse(variants)
+	for _, dimension := range variants {
+		if dimension > 0 && dimension < dimensions[len(dimensions)-1] {
+			dimensions = append(dimensions, dimension)
+		}
+	}
+
+	images := make([]processedImage, 0, len(dimensions))
+	for _, dimension := range dimensions {
+		scaled := scaleImage(img, dimension)
+		body, ext, err := encode(scaled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+		images = append(images, processedImage{
+			body:   body,
+			ext:    ext,
+			width:  scaled.Bounds().Dx(),
+			height: scaled.Bounds().Dy(),
+		})
+	}
+	return images, nil
+}
+
+// scaleImage scales the image down so its longest side is at most the dimension.
+func scaleImage(img image.Image, dimension int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if max(width, height) <= dimension {
+		return img
+	}
+	if width >= height {
+		height = max(1, height*dimension/width)
+		width = dimension
+	} else {
+		width = max(1, width*dimension/height)
+		height = dimension
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return scaled
+}
+
+// applyOrientation rotates and flips the image as described by its EXIF orientation, since the
+// orientation is lost along with the rest of the metadata.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rect := image.Rect(0, 0, width, height)
+	if orientation >= 5 {
+		rect = image.Rect(0, 0, height, width)
+	}
+
+	oriented := image.NewNRGBA(rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // Transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			oriented.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return oriented
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 0 if it has none.
+func jpegOrientation(body []byte) int {
+	exif, err := jpegEXIF(body)
+	if err != nil {
+		return 0
+	}
+	if len(exif) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(exif[4:8]))
+	if ifd+2 > len(exif) {
+		return 0
+	}
+	entries := int(order.Uint16(exif[ifd:]))
+	for i := range entries {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			return 0
+		}
+		if order.Uint16(exif[entry:]) == 0x0112 {
+			return int(order.Uint16(exif[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// jpegEXIF returns the TIFF structure holding the EXIF metadata of a JPEG.
+func jpegEXIF(body []byte) ([]byte, error) {
+	if len(body) < 2 || body[0] != 0xFF || body[1] != 0xD8 {
+		return nil, errors.New("not a jpeg")
+	}
+	for i := 2; i+4 <= len(body); {
+		if body[i] != 0xFF {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		marker := body[i+1]
+		if marker == 0xDA { // The image data starts, there are no more metadata segments
+			break
+		}
+		length := int(binary.BigEndian.Uint16(body[i+2:]))
+		if length < 2 || i+2+length > len(body) {
+			return nil, errors.New("invalid jpeg segment")
+		}
+		segment := body[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		i += 2 + length
+	}
+	return nil, errors.New("no exif metadata")
+}
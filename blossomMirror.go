@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/liamg/magic"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// readBlossomAuthorization reads and checks the Blossom authorization event of the request, which
+// must allow one of the actions. It returns the status code to reply with if it is missing or
+// invalid.
+func readBlossomAuthorization(r *http.Request, actions ...string) (*nostr.Event, int, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nil, 401, errors.New("missing \"Authorization\" header")
+	}
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, 400, errors.New("invalid \"Authorization\": invalid base64 token")
+	}
+	var auth nostr.Event
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, 400, errors.New("invalid \"Authorization\": broken event")
+	}
+	if auth.Kind != 24242 || !auth.CheckID() {
+		return nil, 400, errors.New("invalid \"Authorization\": invalid event")
+	}
+	if ok, _ := auth.CheckSignature(); !ok {
+		return nil, 400, errors.New("invalid \"Authorization\": invalid signature")
+	}
+	expiration := auth.Tags.Find("expiration")
+	if expiration == nil {
+		return nil, 400, errors.New("invalid \"Authorization\": missing \"expiration\" tag")
+	}
+	if expiresAt, _ := strconv.ParseInt(expiration[1], 10, 64); nostr.Timestamp(expiresAt) < nostr.Now() {
+		return nil, 400, errors.New("invalid \"Authorization\": event expired")
+	}
+	for _, action := range actions {
+		if auth.Tags.FindWithValue("t", action) != nil {
+			return &auth, 0, nil
+		}
+	}
+	return nil, 403, errors.New("invalid \"Authorization\" event \"t\" tag")
+}
+
+func blossomError(w http.ResponseWriter, reason string, code int) {
+	w.Header().Add("X-Reason", reason)
+	w.WriteHeader(code)
+}
+
+// rejectUpload runs the RejectUpload hooks of the Blossom server.
+func rejectUpload(ctx context.Context, bl *blossom.BlossomServer, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	for _, reject := range bl.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, size, ext); rejected {
+			return true, reason, code
+		}
+	}
+	return false, "", 0
+}
+
+// keepBlob indexes the blob as owned by the pubkey and stores it, as the Blossom server does with
+// uploads.
+func keepBlob(ctx context.Context, bl *blossom.BlossomServer, pubkey string, sha256 string, body io.Reader, size int64, ext string) (blossom.BlobDescriptor, error) {
+	mimeType := mime.TypeByExtension(ext)
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	bd := blossom.BlobDescriptor{
+		URL:      bl.ServiceURL + "/" + sha256 + ext,
+		SHA256:   sha256,
+		Size:     int(size),
+		Type:     mimeType,
+		Uploaded: nostr.Now(),
+	}
+	if err := bl.Store.Keep(ctx, bd, pubkey); err != nil {
+		return bd, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	slog.Debug("storing blob", "sha256", sha256, "ext", ext)
+	if err := blobStorage.Store(ctx, sha256, body, size, mimeType); err != nil {
+		return bd, fmt.Errorf("failed to save blob: %w", err)
+	}
+	return bd, nil
+}
+
+// preferredExtensions are the usual extensions of MIME types with several.
+var preferredExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"audio/mpeg":      ".mp3",
+}
+
+// blobExtension guesses the extension of a blob from its content, or else from its MIME type or
+// the name it had.
+func blobExtension(body []byte, mimeType string, name string) string {
+	if ft, _ := magic.Lookup(body); ft != nil {
+		return "." + ft.Extension
+	}
+	ext := path.Ext(name)
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	if mimeType = strings.TrimSpace(mimeType); mimeType == "" {
+		return ext
+	}
+	if byExt, _, _ := strings.Cut(mime.TypeByExtension(ext), ";"); ext != "" && byExt == mimeType {
+		return ext
+	}
+	if preferred, ok := preferredExtensions[mimeType]; ok {
+		return preferred
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ext
+}
+
+// maxBlobSize returns the largest blob the pubkey can upload, or -1 if there is no limit.
+func maxBlobSize(pubkey string) int64 {
+	limit := int64(-1)
+	if config.BlossomMaxUploadSizeMB > 0 {
+		limit = int64(config.BlossomMaxUploadSizeMB) * megabyte
+	}
+	if quota, ok := blossomQuotaFor(pubkey); ok && quota.MaxBlobSizeMB > 0 {
+		if quotaLimit := int64(quota.MaxBlobSizeMB) * megabyte; limit < 0 || quotaLimit < limit {
+			limit = quotaLimit
+		}
+	}
+	return limit
+}
+
+// unsizedMirrorLimit is the largest blob mirrored from a server that doesn't tell its size, when
+// the uploader has no size limit.
+const unsizedMirrorLimit = 1024 * megabyte
+
+// mirrorClient downloads the mirrored blobs. It never connects to loopback, private or link-local
+// addresses, so that uploaders can't use Haven to reach services that aren't public, and it
+// ignores HTTP proxies for the same reason.
+var mirrorClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: rejectInternalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// rejectInternalAddress fails for the addresses that aren't on the public internet. It runs once
+// the host name is resolved, so it also applies to names resolving to internal addresses.
+func rejectInternalAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || sharedAddressSpace.Contains(addr) {
+		return fmt.Errorf("refusing to connect to internal address %s", addr)
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which isn't reachable from the internet either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// handleMirror implements BUD-04: it downloads a blob from another server into Haven. The blob
+// must hash to one of the "x" tags of the authorization event.
+func handleMirror(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, code, err := readBlossomAuthorization(r, "upload")
+		if err != nil {
+			blossomError(w, err.Error(), code)
+			return
+		}
+
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+			blossomError(w, "invalid request body: "+err.Error(), 400)
+			return
+		}
+		blobURL, err := url.Parse(body.URL)
+		if err != nil || (blobURL.Scheme != "http" && blobURL.Scheme != "https") {
+			blossomError(w, "invalid blob url", 400)
+			return
+		}
+		var hashes []string
+		for tag := range auth.Tags.FindAll("x") {
+			hashes = append(hashes, tag[1])
+		}
+		if len(hashes) == 0 {
+			blossomError(w, "missing \"x\" tag in authorization event", 400)
+			return
+		}
+		// Only download for the pubkeys that can upload, the size and type are checked once known
+		if rejected, reason, code := RejectUploadNotWhitelisted(r.Context(), auth, 0, ""); rejected {
+			blossomError(w, reason, code)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.BlossomMirrorTimeoutSeconds)*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL.String(), nil)
+		if err != nil {
+			blossomError(w, "invalid blob url", 400)
+			return
+		}
+		req.Header.Set("User-Agent", config.UserAgent)
+		resp, err := mirrorClient.Do(req)
+		if err != nil {
+			blossomError(w, "failed to download blob: "+err.Error(), 502)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			blossomError(w, "failed to download blob: "+resp.Status, 502)
+			return
+		}
+
+		// Check the declared size before downloading, and enforce it while downloading
+		ext := blobExtension(nil, resp.Header.Get("Content-Type"), blobURL.Path)
+		if resp.ContentLength >= 0 {
+			if rejected, reason, code := rejectUpload(r.Context(), bl, auth, int(resp.ContentLength), ext); rejected {
+				blossomError(w, reason, code)
+				return
+			}
+		}
+		limit := maxBlobSize(auth.PubKey)
+		if resp.ContentLength >= 0 && (limit < 0 || resp.ContentLength < limit) {
+			limit = resp.ContentLength
+		} else if limit < 0 {
+			limit = unsizedMirrorLimit
+		}
+		blob, err := stageBlob(resp.Body, limit)
+		if errors.Is(err, errBlobTooLarge) {
+			blossomError(w, fmt.Sprintf("blob is too large, the limit is %s", formatMB(limit)), 413)
+			return
+		} else if err != nil {
+			blossomError(w, "failed to download blob: "+err.Error(), 502)
+			return
+		}
+		defer blob.Close()
+
+		if !slices.Contains(hashes, blob.sha256) {
+			blossomError(w, "blob hash does not match any \"x\" tag in authorization event", 403)
+			return
+		}
+
+		ext = blobExtension(blob.header, resp.Header.Get("Content-Type"), blobURL.Path)
+		if rejected, reason, code := rejectUpload(r.Context(), bl, auth, int(blob.size), ext); rejected {
+			blossomError(w, reason, code)
+			return
+		}
+
+		bd, err := keepStagedBlob(r.Context(), bl, auth.PubKey, blob, ext)
+		if err != nil {
+			blossomError(w, err.Error(), 500)
+			return
+		}
+		slog.Info("🪞 mirrored blob", "sha256", bd.SHA256, "pubkey", auth.PubKey, "url", blobURL.String())
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bd)
+	}
+}
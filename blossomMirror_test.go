@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// newMirroredServer serves the blob, counting the downloads. The mirror client is replaced by one
+// that can reach it, as it refuses loopback addresses.
+func newMirroredServer(t *testing.T, blob []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+	}))
+	t.Cleanup(srv.Close)
+
+	oldClient := mirrorClient
+	mirrorClient = srv.Client()
+	t.Cleanup(func() {
+		mirrorClient = oldClient
+	})
+	return srv, &downloads
+}
+
+func mirror(bl *blossom.BlossomServer, authorization, url string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/mirror", strings.NewReader(`{"url":"`+url+`"}`))
+	r.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	handleMirror(bl).ServeHTTP(w, r)
+	return w
+}
+
+func TestMirror(t *testing.T) {
+	bl, sk := setupTestBlossom(t)
+	blob := []byte("a blob stored on another server")
+	hash := hashOf(blob)
+	srv, _ := newMirroredServer(t, blob)
+
+	w := mirror(bl, blossomAuthorization(t, sk, "upload", hash), srv.URL+"/"+hash)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", w.Code, w.Header().Get("X-Reason"))
+	}
+	var bd blossom.BlobDescriptor
+	if err := json.NewDecoder(w.Body).Decode(&bd); err != nil {
+		t.Fatal(err)
+	}
+	if bd.SHA256 != hash || bd.Size != len(blob) {
+		t.Errorf("descriptor = %+v, want sha256 %s and size %d", bd, hash, len(blob))
+	}
+	if exists, err := blobStorage.Exists(t.Context(), hash); err != nil || !exists {
+		t.Errorf("mirrored blob stored = %v, %v, want true", exists, err)
+	}
+}
+
+func TestMirrorHashMismatch(t *testing.T) {
+	bl, sk := setupTestBlossom(t)
+	blob := []byte("not the blob that was asked for")
+	expected := hashOf([]byte("the blob that was asked for"))
+	srv, downloads := newMirroredServer(t, blob)
+
+	w := mirror(bl, blossomAuthorization(t, sk, "upload", expected), srv.URL+"/"+expected)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d (%s), want 403", w.Code, w.Header().Get("X-Reason"))
+	}
+	if downloads.Load() != 1 {
+		t.Errorf("downloads = %d, want 1", downloads.Load())
+	}
+	for _, hash := range []string{expected, hashOf(blob)} {
+		if exists, _ := blobStorage.Exists(t.Context(), hash); exists {
+			t.Errorf("blob %s was stored", hash)
+		}
+	}
+	if files, _ := afero.ReadDir(fs, blobUploadPath()); len(files) > 0 {
+		t.Errorf("%d staged files left behind", len(files))
+	}
+}
+
+func TestMirrorNotWhitelisted(t *testing.T) {
+	bl, _ := setupTestBlossom(t)
+	blob := []byte("a blob stored on another server")
+	srv, downloads := newMirroredServer(t, blob)
+
+	stranger := nostr.GeneratePrivateKey()
+	w := mirror(bl, blossomAuthorization(t, stranger, "upload", hashOf(blob)), srv.URL)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d (%s), want 403", w.Code, w.Header().Get("X-Reason"))
+	}
+	if downloads.Load() != 0 {
+		t.Errorf("downloads = %d, want none before checking the uploader", downloads.Load())
+	}
+}
+
+func TestMirrorRefusesInternalAddresses(t *testing.T) {
+	bl, sk := setupTestBlossom(t)
+	blob := []byte("a blob on the local network")
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	w := mirror(bl, blossomAuthorization(t, sk, "upload", hashOf(blob)), srv.URL)
+	if reason := w.Header().Get("X-Reason"); w.Code != http.StatusBadGateway || !strings.Contains(reason, "internal address") {
+		t.Fatalf("status = %d (%s), want 502 refusing the internal address", w.Code, reason)
+	}
+	if downloads.Load() != 0 {
+		t.Errorf("downloads = %d, want none", downloads.Load())
+	}
+}
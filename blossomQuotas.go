@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const megabyte = 1024 * 1024
+
+// BlossomQuota limits what a pubkey can upload to the Blossom server. Zero values and an empty list
+// of MIME types disable the matching limit.
+type BlossomQuota struct {
+	MaxBlobSizeMB int      `json:"max_blob_size_mb"`
+	MaxStorageMB  int      `json:"max_storage_mb"`
+	MIMETypes     []string `json:"mime_types"`
+}
+
+// BlossomQuotas are the quotas of specific pubkeys.
+type BlossomQuotas map[string]BlossomQuota
+
+// blossomQuotaOverride is an entry of BLOSSOM_QUOTAS_FILE. Missing fields keep the default quota.
+type blossomQuotaOverride struct {
+	MaxBlobSizeMB *int     `json:"max_blob_size_mb"`
+	MaxStorageMB  *int     `json:"max_storage_mb"`
+	MIMETypes     []string `json:"mime_types"`
+}
+
+func getBlossomQuota() BlossomQuota {
+	return BlossomQuota{
+		MaxBlobSizeMB: getEnvInt("BLOSSOM_MAX_BLOB_SIZE_MB", 0),
+		MaxStorageMB:  getEnvInt("BLOSSOM_MAX_STORAGE_MB", 0),
+		MIMETypes:     getEnvStringList("BLOSSOM_ALLOWED_MIME_TYPES"),
+	}
+}
+
+// getBlossomQuotasFromFile reads the quotas of specific npubs, which are based on the default quota.
+func getBlossomQuotasFromFile(filePath string, defaultQuota BlossomQuota) BlossomQuotas {
+	quotas := make(BlossomQuotas)
+	if filePath == "" {
+		return quotas
+	}
+
+	file, err := os.ReadFile(filePath)
+	if err != nil {
+		log.Fatalf("Failed to read file: %s", err)
+	}
+	var overrides map[string]blossomQuotaOverride
+	if err := json.Unmarshal(file, &overrides); err != nil {
+		log.Fatalf("Failed to parse Blossom quotas file %s: %s", filePath, err)
+	}
+
+	for npub, override := range overrides {
+		prefix, pubkey, err := nip19.Decode(npub)
+		if err != nil || prefix != "npub" {
+			log.Fatalf("Invalid npub %q in Blossom quotas file %s", npub, filePath)
+		}
+		quota := defaultQuota
+		if override.MaxBlobSizeMB != nil {
+			quota.MaxBlobSizeMB = *override.MaxBlobSizeMB
+		}
+		if override.MaxStorageMB != nil {
+			quota.MaxStorageMB = *override.MaxStorageMB
+		}
+		if override.MIMETypes != nil {
+			quota.MIMETypes = override.MIMETypes
+		}
+		quotas[pubkey.(string)] = quota
+	}
+	return quotas
+}
+
+// blossomQuotaFor returns the quota of the pubkey, and false if it has none. The relay owner has no
+// quota unless one is set in BLOSSOM_QUOTAS_FILE.
+func blossomQuotaFor(pubkey string) (BlossomQuota, bool) {
+	if quota, ok := config.BlossomQuotas[pubkey]; ok {
+		return quota, true
+	}
+	if pubkey == config.OwnerPubKey {
+		return BlossomQuota{}, false
+	}
+	return config.BlossomQuota, true
+}
+
+// allowsMIMEType reports whether the quota accepts the MIME type. Types ending in "/*", such as
+// "image/*", match every subtype.
+func (q BlossomQuota) allowsMIMEType(mimeType string) bool {
+	if len(q.MIMETypes) == 0 {
+		return true
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	for _, allowed := range q.MIMETypes {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if allowed == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// blobUsage is how many blobs a pubkey owns and their total size.
+type blobUsage struct {
+	count int
+	size  int64
+}
+
+// blobUsageTracker keeps the storage used by each pubkey, so quotas are checked without scanning the
+// Blossom index on every upload. It is loaded from the index at startup, and kept up to date by
+// usageTrackingIndex and the Blossom garbage collection.
+type blobUsageTracker struct {
+	mu     sync.Mutex
+	usages map[string]blobUsage
+}
+
+var blobUsages = &blobUsageTracker{usages: make(map[string]blobUsage)}
+
+// load counts the blobs of every pubkey in the Blossom index.
+func (u *blobUsageTracker) load(ctx context.Context, db DBBackend) error {
+	usages := make(map[string]blobUsage)
+	err := scanEvents(ctx, db, nostr.Filter{Kinds: []int{24242}}, func(entry *nostr.Event) {
+		usage := usages[entry.PubKey]
+		usage.count++
+		usage.size += indexEntrySize(entry)
+		usages[entry.PubKey] = usage
+	})
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usages = usages
+	return nil
+}
+
+func (u *blobUsageTracker) add(pubkey string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := u.usages[pubkey]
+	usage.count++
+	usage.size += size
+	u.usages[pubkey] = usage
+}
+
+func (u *blobUsageTracker) remove(pubkey string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := u.usages[pubkey]
+	usage.count = max(usage.count-1, 0)
+	usage.size = max(usage.size-size, 0)
+	if usage.count == 0 {
+		delete(u.usages, pubkey)
+	} else {
+		u.usages[pubkey] = usage
+	}
+}
+
+// get returns how many blobs the pubkey owns and their total size.
+func (u *blobUsageTracker) get(pubkey string) (int, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := u.usages[pubkey]
+	return usage.count, usage.size
+}
+
+// indexEntrySize returns the size of the blob of a Blossom index entry.
+func indexEntrySize(entry *nostr.Event) int64 {
+	if tag := entry.Tags.Find("size"); tag != nil {
+		size, _ := strconv.ParseInt(tag[1], 10, 64)
+		return size
+	}
+	return 0
+}
+
+// usageTrackingIndex is the Blossom index, keeping the blob usage of the owners up to date as
+// entries are added and deleted.
+type usageTrackingIndex struct {
+	blossom.EventStoreBlobIndexWrapper
+	usages *blobUsageTracker
+	// mu serializes the changes, so an entry is only counted once
+	mu sync.Mutex
+}
+
+func (idx *usageTrackingIndex) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry, err := idx.entry(ctx, blob.SHA256, pubkey)
+	if err != nil {
+		return err
+	}
+	if err := idx.EventStoreBlobIndexWrapper.Keep(ctx, blob, pubkey); err != nil {
+		return err
+	}
+	if entry == nil {
+		idx.usages.add(pubkey, int64(blob.Size))
+	}
+	return nil
+}
+
+func (idx *usageTrackingIndex) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry, err := idx.entry(ctx, sha256, pubkey)
+	if err != nil {
+		return err
+	}
+	if err := idx.EventStoreBlobIndexWrapper.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+	if entry != nil {
+		idx.usages.remove(pubkey, indexEntrySize(entry))
+	}
+	return nil
+}
+
+// entry returns the index entry of a blob owned by the pubkey, or nil if it doesn't own it.
+func (idx *usageTrackingIndex) entry(ctx context.Context, sha256 string, pubkey string) (*nostr.Event, error) {
+	entries, err := eventstore.RelayWrapper{Store: idx.Store}.QuerySync(ctx, nostr.Filter{
+		Authors: []string{pubkey},
+		Kinds:   []int{24242},
+		Tags:    nostr.TagMap{"x": []string{sha256}},
+		Limit:   1,
+	})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// RejectUploadNotWhitelisted rejects the uploads of the pubkeys that aren't whitelisted.
+func RejectUploadNotWhitelisted(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	if config.WhitelistedPubKeys.Has(auth.PubKey) {
+		return false, ext, size
+	}
+	return true, "only media signed by whitelisted pubkeys are allowed", 403
+}
+
+// RejectUploadOverQuota rejects the uploads that don't fit in the uploader's quota.
+func RejectUploadOverQuota(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	quota, ok := blossomQuotaFor(auth.PubKey)
+	if !ok {
+		return false, ext, size
+	}
+
+	if quota.MaxBlobSizeMB > 0 && size > quota.MaxBlobSizeMB*megabyte {
+		return true, fmt.Sprintf("blob is too large: %s, the limit is %d MB", formatMB(int64(size)), quota.MaxBlobSizeMB), 413
+	}
+
+	if mimeType := mime.TypeByExtension(ext); !quota.allowsMIMEType(mimeType) {
+		if mimeType == "" {
+			mimeType = "unknown"
+		}
+		return true, fmt.Sprintf("file type %s is not allowed, allowed types are %s", mimeType, strings.Join(quota.MIMETypes, ", ")), 403
+	}
+
+	if quota.MaxStorageMB > 0 {
+		count, used := blobUsages.get(auth.PubKey)
+		if used+int64(size) > int64(quota.MaxStorageMB)*megabyte {
+			return true, fmt.Sprintf("storage quota exceeded: using %s in %d blobs, the limit is %d MB", formatMB(used), count, quota.MaxStorageMB), 413
+		}
+	}
+
+	return false, ext, size
+}
+
+func formatMB(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/megabyte)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// memoryDB is an in-memory database for the tests.
+type memoryDB struct {
+	*slicestore.SliceStore
+}
+
+func (memoryDB) Serial() []byte { return nil }
+
+// QueryEvents reads all the results before returning them, as the slice store can't be written to while
+// a query is running, which the Blossom index does when it deletes entries.
+func (db memoryDB) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	results, err := db.SliceStore.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for event := range results {
+		events = append(events, event)
+	}
+	ch := make(chan *nostr.Event, len(events))
+	for _, event := range events {
+		ch <- event
+	}
+	close(ch)
+	return ch, nil
+}
+
+func newMemoryDB(t *testing.T) memoryDB {
+	t.Helper()
+	db := memoryDB{&slicestore.SliceStore{}}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBlobUsageTracking(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDB(t)
+	usages := &blobUsageTracker{usages: make(map[string]blobUsage)}
+	index := &usageTrackingIndex{
+		EventStoreBlobIndexWrapper: blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: "http://localhost:3355"},
+		usages:                     usages,
+	}
+	alice, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bob, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	a := blossom.BlobDescriptor{SHA256: hashOf([]byte("a")), Size: 100, Type: "image/png", Uploaded: nostr.Now()}
+	b := blossom.BlobDescriptor{SHA256: hashOf([]byte("b")), Size: 50, Type: "image/png", Uploaded: nostr.Now()}
+
+	check := func(pubkey string, wantCount int, wantSize int64) {
+		t.Helper()
+		if count, size := usages.get(pubkey); count != wantCount || size != wantSize {
+			t.Errorf("usage = %d blobs, %d bytes, want %d blobs, %d bytes", count, size, wantCount, wantSize)
+		}
+	}
+
+	for _, keep := range []struct {
+		blob   blossom.BlobDescriptor
+		pubkey string
+	}{{a, alice}, {a, alice}, {b, alice}, {a, bob}} {
+		if err := index.Keep(ctx, keep.blob, keep.pubkey); err != nil {
+			t.Fatalf("Keep: %v", err)
+		}
+	}
+	// Keeping a blob the pubkey already owns doesn't count it twice
+	check(alice, 2, 150)
+	check(bob, 1, 100)
+
+	for range 2 {
+		if err := index.Delete(ctx, a.SHA256, alice); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	// Deleting a blob the pubkey doesn't own anymore changes nothing
+	check(alice, 1, 50)
+	check(bob, 1, 100)
+
+	// The usage loaded from the index matches the tracked one
+	loaded := &blobUsageTracker{}
+	if err := loaded.load(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, pubkey := range []string{alice, bob} {
+		wantCount, wantSize := usages.get(pubkey)
+		if count, size := loaded.get(pubkey); count != wantCount || size != wantSize {
+			t.Errorf("loaded usage = %d blobs, %d bytes, want %d blobs, %d bytes", count, size, wantCount, wantSize)
+		}
+	}
+}
+
+func TestRejectUploadOverQuota(t *testing.T) {
+	oldConfig, oldUsages := config, blobUsages
+	t.Cleanup(func() {
+		config, blobUsages = oldConfig, oldUsages
+	})
+	config.OwnerPubKey, _ = nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	config.BlossomQuota = BlossomQuota{MaxStorageMB: 1}
+
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	blobUsages = &blobUsageTracker{usages: map[string]blobUsage{pubkey: {count: 3, size: megabyte - 10}}}
+	auth := &nostr.Event{PubKey: pubkey}
+
+	if reject, msg, _ := RejectUploadOverQuota(context.Background(), auth, 10, ".png"); reject {
+		t.Errorf("upload filling the quota rejected: %s", msg)
+	}
+	if reject, _, code := RejectUploadOverQuota(context.Background(), auth, 11, ".png"); !reject || code != 413 {
+		t.Errorf("upload over the quota = %v, %d, want rejected with 413", reject, code)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// errBlobTooLarge is returned by stageBlob when the body is over the size limit.
+var errBlobTooLarge = errors.New("blob is too large")
+
+// blobUploadPath is the folder uploads are written to while they are received. Leftovers of
+// interrupted uploads are deleted on startup.
+func blobUploadPath() string {
+	return filepath.Join(config.BlossomPath, blobTmpFolder)
+}
+
+// stagedBlob is an upload written to a temporary file, so that large media files are never held in
+// memory. It must be closed to delete the file.
+type stagedBlob struct {
+	file   afero.File
+	sha256 string
+	size   int64
+	header []byte // The first bytes, to guess the file type
+}
+
+// stageBlob writes the body to a temporary file, hashing it along the way. It fails with
+// errBlobTooLarge if the body is larger than limit bytes, unless limit is negative.
+func stageBlob(body io.Reader, limit int64) (*stagedBlob, error) {
+	if err := fs.MkdirAll(blobUploadPath(), 0755); err != nil {
+		return nil, err
+	}
+	file, err := afero.TempFile(fs, blobUploadPath(), "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	blob := &stagedBlob{file: file}
+
+	if limit >= 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(body, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		blob.Close()
+		return nil, err
+	}
+	blob.header = header[:n]
+
+	h := sha256.New()
+	blob.size, err = io.Copy(io.MultiWriter(file, h), io.MultiReader(bytes.NewReader(blob.header), body))
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	if limit >= 0 && blob.size > limit {
+		blob.Close()
+		return nil, errBlobTooLarge
+	}
+	blob.sha256 = hex.EncodeToString(h.Sum(nil))
+	return blob, nil
+}
+
+// rewind returns the content of the blob from the start.
+func (b *stagedBlob) rewind() (io.Reader, error) {
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+func (b *stagedBlob) Close() {
+	b.file.Close()
+	if err := fs.Remove(b.file.Name()); err != nil {
+		slog.Error("🚫 error deleting staged upload", "file", b.file.Name(), "error", err)
+	}
+}
+
+// keepStagedBlob indexes the staged blob as owned by the pubkey and stores it.
+func keepStagedBlob(ctx context.Context, bl *blossom.BlossomServer, pubkey string, blob *stagedBlob, ext string) (blossom.BlobDescriptor, error) {
+	body, err := blob.rewind()
+	if err != nil {
+		return blossom.BlobDescriptor{}, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return keepBlob(ctx, bl, pubkey, blob.sha256, body, blob.size, ext)
+}
+
+// receiveBlob stages the body of an upload request once the RejectUpload hooks accepted its
+// declared size and type, and checks it matches the authorization event. It replies with an error
+// and returns nil if the upload is rejected.
+func receiveBlob(w http.ResponseWriter, r *http.Request, bl *blossom.BlossomServer, auth *nostr.Event) (*stagedBlob, string) {
+	if r.ContentLength <= 0 {
+		blossomError(w, "missing \"Content-Length\" header", 411)
+		return nil, ""
+	}
+	contentType := r.Header.Get("Content-Type")
+	declaredExt := blobExtension(nil, contentType, "")
+	if rejected, reason, code := rejectUpload(r.Context(), bl, auth, int(r.ContentLength), declaredExt); rejected {
+		blossomError(w, reason, code)
+		return nil, ""
+	}
+
+	limit := maxBlobSize(auth.PubKey)
+	blob, err := stageBlob(r.Body, limit)
+	if errors.Is(err, errBlobTooLarge) {
+		blossomError(w, fmt.Sprintf("blob is too large, the limit is %s", formatMB(limit)), 413)
+		return nil, ""
+	} else if err != nil {
+		blossomError(w, "failed to read upload body: "+err.Error(), 400)
+		return nil, ""
+	}
+	if auth.Tags.Find("x") != nil && auth.Tags.FindWithValue("x", blob.sha256) == nil {
+		blob.Close()
+		blossomError(w, "blob hash does not match any \"x\" tag in authorization event", 403)
+		return nil, ""
+	}
+
+	// The content tells the actual type, except for Android packages which are zips
+	ext := blobExtension(blob.header, contentType, "")
+	if ext == ".zip" && declaredExt == ".apk" {
+		ext = declaredExt
+	}
+	if ext != declaredExt {
+		if rejected, reason, code := rejectUpload(r.Context(), bl, auth, int(blob.size), ext); rejected {
+			blob.Close()
+			blossomError(w, reason, code)
+			return nil, ""
+		}
+	}
+	return blob, ext
+}
+
+// handleUpload implements BUD-02 uploads like the Blossom server does, except that the body is
+// streamed to disk instead of being read into memory.
+func handleUpload(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, code, err := readBlossomAuthorization(r, "upload")
+		if err != nil {
+			blossomError(w, err.Error(), code)
+			return
+		}
+		blob, ext := receiveBlob(w, r, bl, auth)
+		if blob == nil {
+			return
+		}
+		defer blob.Close()
+
+		bd, err := keepStagedBlob(r.Context(), bl, auth.PubKey, blob, ext)
+		if err != nil {
+			blossomError(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bd)
+	}
+}
+
+// RejectUploadOverMaxSize rejects the uploads larger than BLOSSOM_MAX_UPLOAD_SIZE_MB, whoever the
+// uploader is.
+func RejectUploadOverMaxSize(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	if config.BlossomMaxUploadSizeMB > 0 && size > config.BlossomMaxUploadSizeMB*megabyte {
+		return true, fmt.Sprintf("blob is too large: %s, the limit is %d MB", formatMB(int64(size)), config.BlossomMaxUploadSizeMB), 413
+	}
+	return false, ext, size
+}
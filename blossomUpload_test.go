@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/spf13/afero"
+)
+
+func upload(bl *blossom.BlossomServer, authorization string, body []byte, contentLength int64) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/upload", bytes.NewReader(body))
+	r.ContentLength = contentLength
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("Authorization", authorization)
+	w := httptest.NewRecorder()
+	handleUpload(bl).ServeHTTP(w, r)
+	return w
+}
+
+func TestUpload(t *testing.T) {
+	bl, sk := setupTestBlossom(t)
+	blob := bytes.Repeat([]byte("media"), 1000)
+	hash := hashOf(blob)
+
+	w := upload(bl, blossomAuthorization(t, sk, "upload", hash), blob, int64(len(blob)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", w.Code, w.Header().Get("X-Reason"))
+	}
+	var bd blossom.BlobDescriptor
+	if err := json.NewDecoder(w.Body).Decode(&bd); err != nil {
+		t.Fatal(err)
+	}
+	if bd.SHA256 != hash || bd.Size != len(blob) {
+		t.Errorf("descriptor = %+v, want sha256 %s and size %d", bd, hash, len(blob))
+	}
+	if exists, err := blobStorage.Exists(t.Context(), hash); err != nil || !exists {
+		t.Errorf("uploaded blob stored = %v, %v, want true", exists, err)
+	}
+}
+
+func TestUploadOverMaxSize(t *testing.T) {
+	bl, sk := setupTestBlossom(t)
+	config.BlossomMaxUploadSizeMB = 1
+	blob := bytes.Repeat([]byte{1}, megabyte+1)
+	hash := hashOf(blob)
+
+	tests := []struct {
+		name          string
+		contentLength int64
+	}{
+		{"declared size", int64(len(blob))},
+		// The body is cut off at the limit whatever the client declares
+		{"understated size", 1000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := upload(bl, blossomAuthorization(t, sk, "upload", hash), blob, test.contentLength)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d (%s), want 413", w.Code, w.Header().Get("X-Reason"))
+			}
+			if exists, _ := blobStorage.Exists(t.Context(), hash); exists {
+				t.Error("blob over the limit was stored")
+			}
+			if files, _ := afero.ReadDir(fs, blobUploadPath()); len(files) > 0 {
+				t.Errorf("%d staged files left behind", len(files))
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -23,50 +24,70 @@ type S3Config struct {
 }
 
 type Config struct {
-	OwnerNpub                            string              `json:"owner_npub"`
-	OwnerPubKey                          string              `json:"owner_pubkey"`
-	DBEngine                             string              `json:"db_engine"`
-	LmdbMapSize                          int64               `json:"lmdb_map_size"`
-	BlossomPath                          string              `json:"blossom_path"`
-	RelayURL                             string              `json:"relay_url"`
-	RelayPort                            int                 `json:"relay_port"`
-	RelayBindAddress                     string              `json:"relay_bind_address"`
-	RelaySoftware                        string              `json:"relay_software"`
-	RelayVersion                         string              `json:"relay_version"`
-	UserAgent                            string              `json:"user_agent"`
-	PrivateRelayName                     string              `json:"private_relay_name"`
-	PrivateRelayNpub                     string              `json:"private_relay_npub"`
-	PrivateRelayDescription              string              `json:"private_relay_description"`
-	PrivateRelayIcon                     string              `json:"private_relay_icon"`
-	ChatRelayName                        string              `json:"chat_relay_name"`
-	ChatRelayNpub                        string              `json:"chat_relay_npub"`
-	ChatRelayDescription                 string              `json:"chat_relay_description"`
-	ChatRelayIcon                        string              `json:"chat_relay_icon"`
-	OutboxRelayName                      string              `json:"outbox_relay_name"`
-	OutboxRelayNpub                      string              `json:"outbox_relay_npub"`
-	OutboxRelayDescription               string              `json:"outbox_relay_description"`
-	OutboxRelayIcon                      string              `json:"outbox_relay_icon"`
-	InboxRelayName                       string              `json:"inbox_relay_name"`
-	InboxRelayNpub                       string              `json:"inbox_relay_npub"`
-	InboxRelayDescription                string              `json:"inbox_relay_description"`
-	InboxRelayIcon                       string              `json:"inbox_relay_icon"`
-	InboxPullIntervalSeconds             int                 `json:"inbox_pull_interval_seconds"`
-	ImportStartDate                      string              `json:"import_start_date"`
-	ImportOwnerNotesFetchTimeoutSeconds  int                 `json:"import_owned_notes_fetch_timeout_seconds"`
-	ImportTaggedNotesFetchTimeoutSeconds int                 `json:"import_tagged_fetch_timeout_seconds"`
-	ImportSeedRelays                     []string            `json:"import_seed_relays"`
-	BackupProvider                       string              `json:"backup_provider"`
-	BackupIntervalHours                  int                 `json:"backup_interval_hours"`
-	WotDepth                             int                 `json:"wot_depth"`
-	WotMinimumFollowers                  int                 `json:"wot_minimum_followers"`
-	WotFetchTimeoutSeconds               int                 `json:"wot_fetch_timeout_seconds"`
-	WotRefreshInterval                   time.Duration       `json:"wot_refresh_interval"`
-	WhitelistedPubKeys                   map[string]struct{} `json:"whitelisted_pubkeys"`
-	BlacklistedPubKeys                   map[string]struct{} `json:"blacklisted_pubkeys"`
-	LogLevel                             string              `json:"log_level"`
-	BlastrRelays                         []string            `json:"blastr_relays"`
-	BlastrTimeoutSeconds                 int                 `json:"blastr_timeout_seconds"`
-	S3Config                             *S3Config           `json:"s3_config"`
+	OwnerNpub                            string        `json:"owner_npub"`
+	OwnerPubKey                          string        `json:"owner_pubkey"`
+	DBEngine                             string        `json:"db_engine"`
+	LmdbMapSize                          int64         `json:"lmdb_map_size"`
+	BlossomPath                          string        `json:"blossom_path"`
+	BlossomQuota                         BlossomQuota  `json:"blossom_quota"`
+	BlossomQuotas                        BlossomQuotas `json:"blossom_quotas"`
+	BlossomStorage                       string        `json:"blossom_storage"`
+	BlossomMedia                         BlossomMedia  `json:"blossom_media"`
+	BlossomMirrorTimeoutSeconds          int           `json:"blossom_mirror_timeout_seconds"`
+	BlossomMaxUploadSizeMB               int           `json:"blossom_max_upload_size_mb"`
+	BlossomGCInterval                    time.Duration `json:"blossom_gc_interval"`
+	BlossomS3Config                      *S3Config     `json:"blossom_s3_config"`
+	RelayURL                             string        `json:"relay_url"`
+	RelayPort                            int           `json:"relay_port"`
+	RelayBindAddress                     string        `json:"relay_bind_address"`
+	RelaySoftware                        string        `json:"relay_software"`
+	RelayVersion                         string        `json:"relay_version"`
+	RelayCountries                       []string      `json:"relay_countries"`
+	RelayLanguageTags                    []string      `json:"relay_language_tags"`
+	UserAgent                            string        `json:"user_agent"`
+	PrivateRelayName                     string        `json:"private_relay_name"`
+	PrivateRelayNpub                     string        `json:"private_relay_npub"`
+	PrivateRelayDescription              string        `json:"private_relay_description"`
+	PrivateRelayIcon                     string        `json:"private_relay_icon"`
+	ChatRelayName                        string        `json:"chat_relay_name"`
+	ChatRelayNpub                        string        `json:"chat_relay_npub"`
+	ChatRelayDescription                 string        `json:"chat_relay_description"`
+	ChatRelayIcon                        string        `json:"chat_relay_icon"`
+	OutboxRelayName                      string        `json:"outbox_relay_name"`
+	OutboxRelayNpub                      string        `json:"outbox_relay_npub"`
+	OutboxRelayDescription               string        `json:"outbox_relay_description"`
+	OutboxRelayIcon                      string        `json:"outbox_relay_icon"`
+	InboxRelayName                       string        `json:"inbox_relay_name"`
+	InboxRelayNpub                       string        `json:"inbox_relay_npub"`
+	InboxRelayDescription                string        `json:"inbox_relay_description"`
+	InboxRelayIcon                       string        `json:"inbox_relay_icon"`
+	InboxPullIntervalSeconds             int           `json:"inbox_pull_interval_seconds"`
+	ImportStartDate                      string        `json:"import_start_date"`
+	ImportOwnerNotesFetchTimeoutSeconds  int           `json:"import_owned_notes_fetch_timeout_seconds"`
+	ImportTaggedNotesFetchTimeoutSeconds int           `json:"import_tagged_fetch_timeout_seconds"`
+	ImportSeedRelays                     []string      `json:"import_seed_relays"`
+	BackupProvider                       string        `json:"backup_provider"`
+	BackupIntervalHours                  int           `json:"backup_interval_hours"`
+	BackupMedia                          bool          `json:"backup_media"`
+	WotDepth                             int           `json:"wot_depth"`
+	WotMinimumFollowers                  int           `json:"wot_minimum_followers"`
+	WotFetchTimeoutSeconds               int           `json:"wot_fetch_timeout_seconds"`
+	WotRefreshInterval                   time.Duration `json:"wot_refresh_interval"`
+	WhitelistedNpubsFile                 string        `json:"whitelisted_npubs_file"`
+	BlacklistedNpubsFile                 string        `json:"blacklisted_npubs_file"`
+	WhitelistedPubKeys                   *PubKeySet    `json:"whitelisted_pubkeys"`
+	BlacklistedPubKeys                   *PubKeySet    `json:"blacklisted_pubkeys"`
+	LogLevel                             string        `json:"log_level"`
+	BlastrRelays                         []string      `json:"blastr_relays"`
+	BlastrRules                          BlastrRules   `json:"blastr_rules"`
+	BlastrTimeoutSeconds                 int           `json:"blastr_timeout_seconds"`
+	BlastrWorkers                        int           `json:"blastr_workers"`
+	BlastrDeadlineSeconds                int           `json:"blastr_deadline_seconds"`
+	BlastrMaxTaggedRelays                int           `json:"blastr_max_tagged_relays"`
+	ShutdownTimeoutSeconds               int           `json:"shutdown_timeout_seconds"`
+	ExpirationPurgeInterval              time.Duration `json:"expiration_purge_interval"`
+	RetentionInterval                    time.Duration `json:"retention_interval"`
+	S3Config                             *S3Config     `json:"s3_config"`
 }
 
 const relaySoftware = "https://github.com/barrydeen/haven"
@@ -80,10 +101,19 @@ func loadConfig() Config {
 		DBEngine:                             getEnvString("DB_ENGINE", "lmdb"),
 		LmdbMapSize:                          getEnvInt64("LMDB_MAPSIZE", 0),
 		BlossomPath:                          getEnvString("BLOSSOM_PATH", "blossom"),
+		BlossomQuota:                         getBlossomQuota(),
+		BlossomStorage:                       getEnvString("BLOSSOM_STORAGE", blobStorageLocal),
+		BlossomS3Config:                      getBlossomS3Config(),
+		BlossomMedia:                         getBlossomMedia(),
+		BlossomMirrorTimeoutSeconds:          getEnvInt("BLOSSOM_MIRROR_TIMEOUT_SECONDS", 60),
+		BlossomMaxUploadSizeMB:               getEnvInt("BLOSSOM_MAX_UPLOAD_SIZE_MB", 0),
+		BlossomGCInterval:                    getEnvDuration("BLOSSOM_GC_INTERVAL", 0),
 		RelayURL:                             getEnv("RELAY_URL"),
 		RelayPort:                            getEnvInt("RELAY_PORT", 3355),
 		RelayBindAddress:                     getEnvString("RELAY_BIND_ADDRESS", "0.0.0.0"),
 		RelaySoftware:                        relaySoftware,
+		RelayCountries:                       getEnvStringList("RELAY_COUNTRIES"),
+		RelayLanguageTags:                    getEnvStringList("RELAY_LANGUAGE_TAGS"),
 		RelayVersion:                         getVersion(),
 		UserAgent:                            fmt.Sprintf("Haven/%s (+%s)", getVersion(), relaySoftware),
 		PrivateRelayName:                     getEnv("PRIVATE_RELAY_NAME"),
@@ -109,20 +139,31 @@ func loadConfig() Config {
 		ImportSeedRelays:                     getRelayListFromFile(getEnv("IMPORT_SEED_RELAYS_FILE")),
 		BackupProvider:                       getEnvString("BACKUP_PROVIDER", "none"),
 		BackupIntervalHours:                  getEnvInt("BACKUP_INTERVAL_HOURS", 24),
+		BackupMedia:                          getEnvBool("BACKUP_MEDIA", false),
 		WotDepth:                             getEnvInt("WOT_DEPTH", 3),
 		WotMinimumFollowers:                  getEnvInt("WOT_MINIMUM_FOLLOWERS", 0),
 		WotFetchTimeoutSeconds:               getEnvInt("WOT_FETCH_TIMEOUT_SECONDS", 30),
 		WotRefreshInterval:                   getEnvDuration("WOT_REFRESH_INTERVAL", 24*time.Hour),
-		WhitelistedPubKeys:                   getNpubsFromFile(getEnvString("WHITELISTED_NPUBS_FILE", "")),
-		BlacklistedPubKeys:                   getNpubsFromFile(getEnvString("BLACKLISTED_NPUBS_FILE", "")),
+		WhitelistedNpubsFile:                 getEnvString("WHITELISTED_NPUBS_FILE", ""),
+		BlacklistedNpubsFile:                 getEnvString("BLACKLISTED_NPUBS_FILE", ""),
 		LogLevel:                             getEnvString("HAVEN_LOG_LEVEL", "INFO"),
-		BlastrRelays:                         getRelayListFromFile(getEnv("BLASTR_RELAYS_FILE")),
 		BlastrTimeoutSeconds:                 getEnvInt("BLASTR_TIMEOUT_SECONDS", 5),
+		BlastrWorkers:                        getEnvInt("BLASTR_WORKERS", 10),
+		BlastrDeadlineSeconds:                getEnvInt("BLASTR_DEADLINE_SECONDS", 60),
+		BlastrMaxTaggedRelays:                getEnvInt("BLASTR_MAX_TAGGED_RELAYS", 10),
+		ShutdownTimeoutSeconds:               getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30),
+		ExpirationPurgeInterval:              getEnvDuration("EXPIRATION_PURGE_INTERVAL", time.Hour),
+		RetentionInterval:                    getEnvDuration("RETENTION_INTERVAL", 6*time.Hour),
 		S3Config:                             getS3Config(),
 	}
 
-	// Relay owner is always whitelisted
-	cfg.WhitelistedPubKeys[cfg.OwnerPubKey] = struct{}{}
+	// Access lists are loaded from the access store once the databases are open; until then,
+	// only the relay owner is whitelisted.
+	cfg.WhitelistedPubKeys = NewPubKeySet(map[string]struct{}{cfg.OwnerPubKey: {}})
+	cfg.BlacklistedPubKeys = NewPubKeySet(map[string]struct{}{})
+
+	cfg.BlastrRelays, cfg.BlastrRules = getBlastrConfigFromFile(getEnv("BLASTR_RELAYS_FILE"))
+	cfg.BlossomQuotas = getBlossomQuotasFromFile(getEnvString("BLOSSOM_QUOTAS_FILE", ""), cfg.BlossomQuota)
 
 	return cfg
 
@@ -152,6 +193,23 @@ func getS3Config() *S3Config {
 	return nil
 }
 
+// getBlossomS3Config returns the bucket used when BLOSSOM_STORAGE is "s3", or by the blossom migrate
+// command, if one is set.
+func getBlossomS3Config() *S3Config {
+	bucketName := getEnvString("BLOSSOM_S3_BUCKET_NAME", "")
+	if bucketName == "" {
+		return nil
+	}
+
+	return &S3Config{
+		AccessKeyID: getEnv("BLOSSOM_S3_ACCESS_KEY_ID"),
+		SecretKey:   getEnv("BLOSSOM_S3_SECRET_KEY"),
+		Endpoint:    getEnv("BLOSSOM_S3_ENDPOINT"),
+		BucketName:  bucketName,
+		Region:      getEnvString("BLOSSOM_S3_REGION", ""),
+	}
+}
+
 func getRelayListFromFile(filePath string) []string {
 	file, err := os.ReadFile(filePath)
 	if err != nil {
@@ -173,27 +231,19 @@ func getRelayListFromFile(filePath string) []string {
 	return relayList
 }
 
-func getNpubsFromFile(filePath string) map[string]struct{} {
-	pubKeys := map[string]struct{}{}
-	if filePath == "" {
-		// No pubKeys file, only owner will be whitelisted"
-		return pubKeys
-	}
+// getBlastrConfigFromFile reads the blastr relays, and the rules deciding what is blasted to them,
+// from either a plain array of relays or the extended format described in docs/blastr.md.
+func getBlastrConfigFromFile(filePath string) ([]string, BlastrRules) {
 	file, err := os.ReadFile(filePath)
 	if err != nil {
 		log.Fatalf("Failed to read file: %s", err)
 	}
 
-	var npubs []string
-	if err := json.Unmarshal(file, &npubs); err != nil {
-		log.Fatalf("Failed to parse JSON: %s", err)
-	}
-
-	for _, npub := range npubs {
-		npub = strings.TrimSpace(npub)
-		pubKeys[nPubToPubkey(npub)] = struct{}{}
+	relays, rules, err := parseBlastrFile(file)
+	if err != nil {
+		log.Fatalf("Failed to parse blastr relays file %s: %s", filePath, err)
 	}
-	return pubKeys
+	return relays, rules
 }
 
 func getEnv(key string) string {
@@ -211,6 +261,17 @@ func getEnvString(key string, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvStringList reads a comma separated list, ignoring empty items.
+func getEnvStringList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value, ok := os.LookupEnv(key); ok {
 		intValue, err := strconv.Atoi(value)
@@ -222,6 +283,21 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvIntList(key string, defaultValue []int) []int {
+	if _, ok := os.LookupEnv(key); !ok {
+		return defaultValue
+	}
+	var list []int
+	for _, item := range getEnvStringList(key) {
+		intValue, err := strconv.Atoi(item)
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, intValue)
+	}
+	return list
+}
+
 func getEnvInt64(key string, defaultValue int64) int64 {
 	if value, ok := os.LookupEnv(key); ok {
 		intValue, err := strconv.ParseInt(value, 10, 64)
@@ -244,6 +320,28 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+func getEnvKinds(key string, defaultValue []KindRange) []KindRange {
+	if value, ok := os.LookupEnv(key); ok {
+		kinds, err := parseKindRanges(value)
+		if err != nil {
+			panic(err)
+		}
+		return kinds
+	}
+	return defaultValue
+}
+
+func getEnvKindMaxAges(key string, defaultValue []KindMaxAge) []KindMaxAge {
+	if value, ok := os.LookupEnv(key); ok {
+		ages, err := parseKindMaxAges(value)
+		if err != nil {
+			panic(err)
+		}
+		return ages
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value, ok := os.LookupEnv(key); ok {
 		durationValue, err := time.ParseDuration(value)
@@ -255,6 +353,25 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+// parseDurationWithDays parses a Go duration, also accepting a number of days such as "7d".
+func parseDurationWithDays(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+	return d, nil
+}
+
 func nPubToPubkey(nPub string) string {
 	_, v, err := nip19.Decode(nPub)
 	if err != nil {
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// kindRequestToVanish is the NIP-62 request to vanish kind.
+const kindRequestToVanish = 62
+
+// vanishAllRelays is the "relay" tag value of requests to vanish from every relay.
+const vanishAllRelays = "ALL_RELAYS"
+
+// eventDBs are the stores of the four relays, which deletion and vanish requests are applied to.
+// They are set up by newDBBackends.
+var eventDBs map[string]DBBackend
+
+// blossomServer is the Blossom server of the outbox relay, set up by initRelays.
+var blossomServer *blossom.BlossomServer
+
+// blobURLPattern matches the sha256 in Blossom URLs, such as https://example.com/<sha256>.png.
+var blobURLPattern = regexp.MustCompile(`/([0-9a-f]{64})\b`)
+
+// applyDeletions returns an OnEventSaved hook applying the deletion and vanish requests saved to the
+// relay to the other relays too. It uses the given context rather than the client's, so the
+// requests are fully applied even if the client disconnects.
+func applyDeletions(ctx context.Context, relayName string) func(context.Context, *nostr.Event) {
+	return func(_ context.Context, event *nostr.Event) {
+		switch event.Kind {
+		case nostr.KindDeletion:
+			applyDeletionRequest(ctx, relayName, event)
+		case kindRequestToVanish:
+			applyVanishRequest(ctx, relayName, event)
+		}
+	}
+}
+
+// applyDeletionRequest deletes the events referenced by a NIP-09 deletion request from every relay,
+// along with the blobs they reference that the author uploaded. Only the events signed by the
+// author of the request are deleted. The request is kept on every relay it deleted events from, so
+// they can't be published again, and forwarded through blastr if it deleted outbox events.
+func applyDeletionRequest(ctx context.Context, relayName string, deletion *nostr.Event) {
+	var filters []nostr.Filter
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			filters = append(filters, nostr.Filter{IDs: []string{tag[1]}, Authors: []string{deletion.PubKey}})
+		case "a":
+			spl := strings.SplitN(tag[1], ":", 3)
+			if len(spl) != 3 || spl[1] != deletion.PubKey {
+				continue
+			}
+			kind, err := strconv.Atoi(spl[0])
+			if err != nil {
+				continue
+			}
+			filters = append(filters, nostr.Filter{
+				Kinds:   []int{kind},
+				Authors: []string{deletion.PubKey},
+				Tags:    nostr.TagMap{"d": []string{spl[2]}},
+				Until:   &deletion.CreatedAt,
+			})
+		}
+	}
+	if len(filters) == 0 {
+		return
+	}
+
+	deleted := 0
+	for name, db := range eventDBs {
+		events := deleteEvents(ctx, name, db, filters, func(ev *nostr.Event) bool {
+			// Deleting a deletion request has no effect
+			return ev.Kind != nostr.KindDeletion
+		})
+		if len(events) == 0 {
+			continue
+		}
+		deleted += len(events)
+		deleteReferencedBlobs(ctx, deletion.PubKey, events)
+
+		if name == relayName {
+			continue
+		}
+		if err := db.SaveEvent(ctx, deletion); err != nil && err != eventstore.ErrDupEvent {
+			slog.Error("🚫 error saving deletion request", "relay", name, "id", deletion.ID, "error", err)
+		}
+		if name == "outbox" {
+			blast(ctx, deletion)
+		}
+	}
+	if deleted > 0 {
+		slog.Info("🗑️ deletion request applied", "id", deletion.ID, "pubkey", deletion.PubKey, "deleted", deleted)
+	}
+}
+
+// applyVanishRequest deletes every event the author published before a NIP-62 request to vanish,
+// the gift wraps sent to them and the blobs they uploaded. The request itself is kept, so the
+// deleted events can't be published again, and requests to vanish from all relays are forwarded
+// through blastr.
+func applyVanishRequest(ctx context.Context, relayName string, vanish *nostr.Event) {
+	vanishRequests.add(vanish)
+
+	until := vanish.CreatedAt
+	filters := []nostr.Filter{
+		{Authors: []string{vanish.PubKey}, Until: &until},
+		{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": []string{vanish.PubKey}}, Until: &until},
+	}
+
+	deleted := 0
+	for name, db := range eventDBs {
+		deleted += len(deleteEvents(ctx, name, db, filters, func(ev *nostr.Event) bool {
+			return ev.ID != vanish.ID
+		}))
+	}
+
+	blobs := 0
+	hashes := make(map[string]struct{})
+	err := scanEvents(ctx, blossomDB, nostr.Filter{Kinds: []int{24242}, Authors: []string{vanish.PubKey}}, func(entry *nostr.Event) {
+		if x := entry.Tags.Find("x"); x != nil {
+			hashes[x[1]] = struct{}{}
+		}
+	})
+	if err != nil {
+		slog.Error("🚫 error listing blobs", "pubkey", vanish.PubKey, "error", err)
+	}
+	for sha256 := range hashes {
+		if deleteOwnedBlob(ctx, sha256, vanish.PubKey) {
+			blobs++
+		}
+	}
+
+	slog.Info("👻 request to vanish applied", "pubkey", vanish.PubKey, "deleted", deleted, "blobs", blobs)
+
+	// The outbox relay blasts the events it stores on its own
+	if relayName != "outbox" && vanishesFromAllRelays(vanish) {
+		blast(ctx, vanish)
+	}
+}
+
+// deleteEvents deletes the events matching the filters for which keep returns true, and returns them.
+func deleteEvents(ctx context.Context, name string, db DBBackend, filters []nostr.Filter, keep func(*nostr.Event) bool) []*nostr.Event {
+	var deleted []*nostr.Event
+	for _, filter := range filters {
+		// Collect the events first, as some engines can't delete while iterating, and page through
+		// them as a single query only returns the newest ones
+		var events []*nostr.Event
+		err := scanEvents(ctx, db, filter, func(ev *nostr.Event) {
+			events = append(events, ev)
+		})
+		if err != nil {
+			slog.Error("🚫 error querying events to delete", "relay", name, "error", err)
+			continue
+		}
+		for _, ev := range events {
+			if !keep(ev) {
+				continue
+			}
+			if err := db.DeleteEvent(ctx, ev); err != nil {
+				slog.Error("🚫 error deleting event", "relay", name, "id", ev.ID, "error", err)
+				continue
+			}
+			slog.Debug("🗑️ deleted event", "relay", name, "id", ev.ID, "kind", ev.Kind)
+			deleted = append(deleted, ev)
+		}
+	}
+
+	ids := make([]string, len(deleted))
+	for i, ev := range deleted {
+		ids[i] = ev.ID
+	}
+	blastr.cancel(ids)
+
+	return deleted
+}
+
+// deleteReferencedBlobs deletes the blobs referenced by the events that were uploaded by the pubkey.
+func deleteReferencedBlobs(ctx context.Context, pubkey string, events []*nostr.Event) {
+	for _, ev := range events {
+		for _, sha256 := range referencedBlobs(ev) {
+			deleteOwnedBlob(ctx, sha256, pubkey)
+		}
+	}
+}
+
+// referencedBlobs returns the sha256 of the blobs in "x" and "imeta" tags, and in Blossom URLs.
+func referencedBlobs(ev *nostr.Event) []string {
+	var hashes []string
+	addURLs := func(s string) {
+		for _, match := range blobURLPattern.FindAllStringSubmatch(s, -1) {
+			hashes = appendUnique(hashes, match[1])
+		}
+	}
+
+	addURLs(ev.Content)
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "x":
+			hashes = appendUnique(hashes, tag[1])
+		case "imeta":
+			for _, field := range tag[1:] {
+				if sha256, ok := strings.CutPrefix(field, "x "); ok {
+					hashes = appendUnique(hashes, sha256)
+				} else {
+					addURLs(field)
+				}
+			}
+		case "url", "r":
+			addURLs(tag[1])
+		}
+	}
+	return hashes
+}
+
+// deleteOwnedBlob drops the pubkey from the owners of the blob, and deletes the blob once no one
+// else owns it, like a Blossom delete request would. It reports whether the pubkey owned the blob.
+func deleteOwnedBlob(ctx context.Context, sha256, pubkey string) bool {
+	owned, err := eventstore.RelayWrapper{Store: blossomDB}.QuerySync(ctx, nostr.Filter{
+		Authors: []string{pubkey},
+		Kinds:   []int{24242},
+		Tags:    nostr.TagMap{"x": []string{sha256}},
+		Limit:   1,
+	})
+	if err != nil || len(owned) == 0 {
+		return false
+	}
+
+	var ext string
+	if bd, err := blossomServer.Store.Get(ctx, sha256); err == nil && bd != nil {
+		if exts, _ := mime.ExtensionsByType(bd.Type); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	if err := blossomServer.Store.Delete(ctx, sha256, pubkey); err != nil {
+		slog.Error("🚫 error deleting blob entry", "sha256", sha256, "pubkey", pubkey, "error", err)
+		return false
+	}
+	if bd, err := blossomServer.Store.Get(ctx, sha256); err == nil && bd == nil {
+		for _, del := range blossomServer.DeleteBlob {
+			if err := del(ctx, sha256, ext); err != nil {
+				slog.Error("🚫 error deleting blob", "sha256", sha256, "error", err)
+			}
+		}
+	}
+	slog.Debug("🗑️ deleted blob", "sha256", sha256, "pubkey", pubkey)
+	return true
+}
+
+// vanishesFromAllRelays reports whether the request to vanish targets every relay.
+func vanishesFromAllRelays(vanish *nostr.Event) bool {
+	return vanish.Tags.FindWithValue("relay", vanishAllRelays) != nil
+}
+
+// vanishTargetsHaven reports whether the request to vanish targets Haven's relays.
+func vanishTargetsHaven(vanish *nostr.Event) bool {
+	for tag := range vanish.Tags.FindAll("relay") {
+		if len(tag) < 2 {
+			continue
+		}
+		if tag[1] == vanishAllRelays {
+			return true
+		}
+		url := strings.TrimSuffix(nostr.NormalizeURL(tag[1]), "/")
+		host, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(url, "wss://"), "ws://"), "/")
+		if host == config.RelayURL {
+			return true
+		}
+	}
+	return false
+}
+
+// VanishRequests keeps track of the latest request to vanish of each pubkey, so the events they
+// deleted can't be published again.
+type VanishRequests struct {
+	mu    sync.RWMutex
+	since map[string]nostr.Timestamp
+}
+
+var vanishRequests = &VanishRequests{since: make(map[string]nostr.Timestamp)}
+
+// loadVanishRequests reads the requests to vanish kept by the relays.
+func loadVanishRequests(ctx context.Context) {
+	for name, db := range eventDBs {
+		ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{kindRequestToVanish}})
+		if err != nil {
+			slog.Error("🚫 error loading requests to vanish", "relay", name, "error", err)
+			continue
+		}
+		for ev := range ch {
+			vanishRequests.add(ev)
+		}
+	}
+}
+
+func (v *VanishRequests) add(vanish *nostr.Event) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if vanish.CreatedAt > v.since[vanish.PubKey] {
+		v.since[vanish.PubKey] = vanish.CreatedAt
+	}
+}
+
+// Covers reports whether the event was deleted by a request to vanish, either because its author
+// vanished after publishing it or because it is a gift wrap sent to someone who vanished since.
+func (v *VanishRequests) Covers(event *nostr.Event) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if len(v.since) == 0 || event.Kind == kindRequestToVanish {
+		return false
+	}
+	if at, ok := v.since[event.PubKey]; ok && event.CreatedAt <= at {
+		return true
+	}
+	if event.Kind == nostr.KindGiftWrap {
+		for tag := range event.Tags.FindAll("p") {
+			if at, ok := v.since[tag[1]]; ok && event.CreatedAt <= at {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HonourVanishRequests only accepts requests to vanish from whitelisted pubkeys targeting Haven's
+// relays, and rejects the events deleted by earlier requests to vanish.
+func HonourVanishRequests(_ context.Context, event *nostr.Event) (bool, string) {
+	if event.Kind == kindRequestToVanish {
+		if !config.WhitelistedPubKeys.Has(event.PubKey) {
+			return true, "restricted: only whitelisted users can vanish from this relay"
+		}
+		if !vanishTargetsHaven(event) {
+			return true, "invalid: request to vanish doesn't target this relay"
+		}
+		return false, ""
+	}
+	if vanishRequests.Covers(event) {
+		return true, "blocked: the author of this event has vanished"
+	}
+	return false, ""
+}
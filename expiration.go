@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// scanPageSize is how many events scanEvents reads at once.
+const scanPageSize = 1000
+
+// isExpired reports whether the event has a NIP-40 expiration date that has passed.
+func isExpired(event *nostr.Event, now nostr.Timestamp) bool {
+	expiresAt := nip40.GetExpiration(event.Tags)
+	return expiresAt != -1 && expiresAt <= now
+}
+
+// RejectExpiredEvents rejects the events whose NIP-40 expiration date has already passed.
+func RejectExpiredEvents(_ context.Context, event *nostr.Event) (bool, string) {
+	if isExpired(event, nostr.Now()) {
+		return true, "invalid: event has expired"
+	}
+	return false, ""
+}
+
+// WithoutExpiredEvents wraps a QueryEvents function to leave out the expired events that haven't
+// been purged yet.
+func WithoutExpiredEvents(query func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		filtered := make(chan *nostr.Event)
+		go func() {
+			defer close(filtered)
+			now := nostr.Now()
+			for event := range ch {
+				if isExpired(event, now) {
+					continue
+				}
+				select {
+				case filtered <- event:
+				case <-ctx.Done():
+					// Let the store finish its query
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+		return filtered, nil
+	}
+}
+
+// purgeExpiredEvents deletes the expired events from the relays every interval, until ctx is done.
+func purgeExpiredEvents(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("⌛ purging expired events is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purgeExpired(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeExpired(ctx context.Context) {
+	now := nostr.Now()
+	for name, db := range eventDBs {
+		var expired []*nostr.Event
+		err := scanEvents(ctx, db, nostr.Filter{}, func(event *nostr.Event) {
+			if isExpired(event, now) {
+				expired = append(expired, event)
+			}
+		})
+		if err != nil {
+			slog.Error("🚫 error looking for expired events", "relay", name, "error", err)
+			continue
+		}
+
+		var ids []string
+		for _, event := range expired {
+			if err := db.DeleteEvent(ctx, event); err != nil {
+				slog.Error("🚫 error deleting expired event", "relay", name, "id", event.ID, "error", err)
+				continue
+			}
+			ids = append(ids, event.ID)
+		}
+		blastr.cancel(ids)
+
+		if len(ids) > 0 {
+			slog.Info("⌛ purged expired events", "relay", name, "count", len(ids))
+		}
+	}
+}
+
+// scanEvents calls fn for every event in the store matching the filter, from the newest to the
+// oldest, reading them a page at a time so the store isn't held busy by a long query. The limit of
+// the filter is ignored.
+func scanEvents(ctx context.Context, db DBBackend, filter nostr.Filter, fn func(*nostr.Event)) error {
+	until := filter.Until
+	// Pages overlap on their oldest timestamp, so remember what was already seen there
+	seen := make(map[string]struct{})
+
+	for {
+		filter.Until = until
+		filter.Limit = scanPageSize
+		ch, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		var events []*nostr.Event
+		for event := range ch {
+			events = append(events, event)
+		}
+
+		found := false
+		for _, event := range events {
+			if _, ok := seen[event.ID]; ok {
+				continue
+			}
+			if until == nil || event.CreatedAt < *until {
+				oldest := event.CreatedAt
+				until = &oldest
+				clear(seen)
+			}
+			seen[event.ID] = struct{}{}
+			found = true
+			fn(event)
+		}
+		if !found || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
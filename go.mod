@@ -3,13 +3,16 @@ module github.com/barrydeen/haven
 go 1.24.1
 
 require (
+	github.com/fasthttp/websocket v1.5.12
 	github.com/fiatjaf/eventstore v0.17.5
 	github.com/fiatjaf/khatru v0.19.1
 	github.com/joho/godotenv v1.5.1
+	github.com/liamg/magic v0.0.1
 	github.com/minio/minio-go/v7 v7.0.98
 	github.com/nbd-wtf/go-nostr v0.52.3
 	github.com/puzpuzpuz/xsync/v4 v4.4.0
 	github.com/spf13/afero v1.15.0
+	golang.org/x/image v0.36.0
 )
 
 require (
@@ -33,7 +36,6 @@ require (
 	github.com/dgraph-io/badger/v4 v4.8.0 // indirect
 	github.com/dgraph-io/ristretto/v2 v2.3.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
-	github.com/fasthttp/websocket v1.5.12 // indirect
 	github.com/go-ini/ini v1.67.0 // indirect
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
@@ -44,7 +46,6 @@ require (
 	github.com/klauspost/compress v1.18.4 // indirect
 	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
 	github.com/klauspost/crc32 v1.3.0 // indirect
-	github.com/liamg/magic v0.0.1 // indirect
 	github.com/mailru/easyjson v0.9.1 // indirect
 	github.com/minio/crc64nvme v1.1.1 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
@@ -9,10 +9,12 @@ import (
 	"maps"
 	"os"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v4"
 
 	"github.com/barrydeen/haven/pkg/wot"
 )
@@ -41,8 +43,27 @@ func ensureImportRelays() {
 	}
 }
 
+const (
+	importWindow         = 240 * time.Hour
+	importPageSize       = 500
+	importMaxAttempts    = 5
+	importInitialBackoff = 2 * time.Second
+	importMaxBackoff     = time.Minute
+)
+
+type importOptions struct {
+	since    time.Time
+	until    time.Time
+	resume   bool
+	seedOnly bool
+}
+
 func runImport(ctx context.Context) {
 	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	resume := importCmd.Bool("resume", false, "Resume the owner notes import from the last checkpoint")
+	since := importCmd.String("since", "", "Import owner notes created on or after this date (YYYY-MM-DD, defaults to IMPORT_START_DATE)")
+	until := importCmd.String("until", "", "Import owner notes created before this date (YYYY-MM-DD, defaults to now)")
+	seedOnly := importCmd.Bool("seed-relays-only", false, "Only import from the seed relays, ignoring the relay lists (NIP-65) of whitelisted pubkeys")
 	importCmd.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage of import:\n")
 		importCmd.PrintDefaults()
@@ -53,10 +74,32 @@ func runImport(ctx context.Context) {
 		return
 	}
 
+	opts := importOptions{
+		until:    time.Now(),
+		resume:   *resume,
+		seedOnly: *seedOnly,
+	}
+	if *since == "" {
+		*since = config.ImportStartDate
+	}
+	if opts.since, err = time.Parse(layout, *since); err != nil {
+		log.Fatal("🚫 invalid start date:", err)
+	}
+	if *until != "" {
+		if opts.until, err = time.Parse(layout, *until); err != nil {
+			log.Fatal("🚫 invalid end date:", err)
+		}
+	}
+	if !opts.since.Before(opts.until) {
+		log.Fatal("🚫 the start date must be before the end date")
+	}
+
 	initDBs()
+	defer closeDBs()
+	initManagement(ctx)
 	wotModel := wot.NewSimpleInMemory(
 		pool,
-		config.WhitelistedPubKeys,
+		config.WhitelistedPubKeys.Load(),
 		config.ImportSeedRelays,
 		config.WotDepth,
 		config.WotMinimumFollowers,
@@ -64,133 +107,314 @@ func runImport(ctx context.Context) {
 	)
 	wot.Initialize(ctx, wotModel)
 
+	var relayLists map[string]relayList
+	if !opts.seedOnly {
+		log.Println("🔎 fetching relay lists of whitelisted pubkeys")
+		relayLists = fetchRelayLists(ctx, config.ImportSeedRelays, config.WhitelistedPubKeys.Keys(),
+			time.Duration(config.ImportOwnerNotesFetchTimeoutSeconds)*time.Second)
+		log.Println("🔎 found relay lists for", len(relayLists), "whitelisted pubkeys")
+	}
+
 	log.Println("📦 importing notes")
-	importOwnerNotes(ctx)
-	importTaggedNotes(ctx)
+	importOwnerNotes(ctx, opts, ownerImportRelays(relayLists))
+	importTaggedNotes(ctx, taggedImportRelays(relayLists))
 }
 
-func importOwnerNotes(ctx context.Context) {
-	ownerImportedNotes := 0
-	nFailedImportNotes := 0
-	wdb := eventstore.RelayWrapper{Store: outboxDB}
-
-	startTime, err := time.Parse(layout, config.ImportStartDate)
-	if err != nil {
-		fmt.Println("Error parsing start date:", err)
-		return
+// ownerImportRelays maps each relay to the authors whose notes should be fetched from it: every
+// whitelisted pubkey on the seed relays, plus each pubkey on its own write relays.
+func ownerImportRelays(relayLists map[string]relayList) map[string][]string {
+	authors := config.WhitelistedPubKeys.Keys()
+	relays := make(map[string][]string)
+	seeds := make(map[string]string, len(config.ImportSeedRelays))
+	for _, url := range config.ImportSeedRelays {
+		relays[url] = authors
+		seeds[nostr.NormalizeURL(url)] = url
 	}
-	endTime := startTime.Add(240 * time.Hour)
 
-	for {
-		startTimestamp := nostr.Timestamp(startTime.Unix())
-		endTimestamp := nostr.Timestamp(endTime.Unix())
+	for pubkey, rl := range relayLists {
+		if !config.WhitelistedPubKeys.Has(pubkey) {
+			continue
+		}
+		for _, url := range rl.Write {
+			if _, ok := seeds[url]; ok {
+				continue
+			}
+			relays[url] = append(relays[url], pubkey)
+		}
+	}
+	return relays
+}
 
-		filter := nostr.Filter{
-			Authors: slices.Collect(maps.Keys(config.WhitelistedPubKeys)),
-			Since:   &startTimestamp,
-			Until:   &endTimestamp,
+// taggedImportRelays returns the seed relays plus the read relays of every whitelisted pubkey.
+func taggedImportRelays(relayLists map[string]relayList) []string {
+	relays := slices.Clone(config.ImportSeedRelays)
+	seen := make(map[string]struct{}, len(relays))
+	for _, url := range relays {
+		seen[nostr.NormalizeURL(url)] = struct{}{}
+	}
+	for _, rl := range relayLists {
+		for _, url := range rl.Read {
+			if _, ok := seen[url]; ok {
+				continue
+			}
+			seen[url] = struct{}{}
+			relays = append(relays, url)
 		}
+	}
+	return relays
+}
+
+// importOwnerNotes walks the import period in fixed windows, fetching the notes of whitelisted
+// pubkeys from every relay concurrently. Progress is checkpointed per relay after each window,
+// so an interrupted import can be continued with --resume.
+func importOwnerNotes(ctx context.Context, opts importOptions, relays map[string][]string) {
+	since := nostr.Timestamp(opts.since.Unix())
+	until := nostr.Timestamp(opts.until.Unix())
 
-		done := make(chan int, 1)
-		timeout := time.Duration(config.ImportOwnerNotesFetchTimeoutSeconds) * time.Second
-		ctx, cancel := context.WithTimeout(ctx, timeout)
+	cp := newImportCheckpoint(since)
+	if opts.resume {
+		cp = loadImportCheckpoint(since)
+	}
 
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		stats = make(map[string]importStats, len(relays))
+		// Events already stored by any relay in this run, to avoid writing them again
+		stored = xsync.NewMap[string, struct{}]()
+	)
+	log.Println("📦 importing owner notes from", len(relays), "relays")
+	for url, authors := range relays {
+		wg.Add(1)
 		go func() {
-			defer cancel()
-			batchImportedNotes := 0
-
-			events := pool.FetchMany(ctx, config.ImportSeedRelays, filter)
-			for ev := range events {
-				if ctx.Err() != nil {
-					break // Stop the loop on timeout
-				}
-				if _, ok := config.BlacklistedPubKeys[ev.PubKey]; ok {
-					slog.Debug("🚫 skipping event from blacklisted pubkey", "pubkey", ev.PubKey, "id", ev.ID)
-					continue
-				}
-				if err := wdb.Publish(ctx, *ev.Event); err != nil {
-					log.Println("🚫  error importing note", ev.ID, ":", err)
-					nFailedImportNotes++
-				}
-				batchImportedNotes++
-			}
-			done <- batchImportedNotes
-			close(done)
+			defer wg.Done()
+			s := importOwnerNotesFromRelay(ctx, url, authors, until, cp, stored)
+			mu.Lock()
+			stats[url] = s
+			mu.Unlock()
 		}()
+	}
+	wg.Wait()
+
+	var total importStats
+	log.Println("📊 owner note import per relay:")
+	for _, url := range slices.Sorted(maps.Keys(stats)) {
+		s := stats[url]
+		log.Printf("   %s: fetched %d, stored %d, failed %d, pages %d", url, s.fetched, s.stored, s.failed, s.pages)
+		total.stored += s.stored
+		total.failed += s.failed
+	}
 
-		select {
-		case batchImportedNotes := <-done:
-			ownerImportedNotes += batchImportedNotes
-			if batchImportedNotes == 0 {
-				log.Printf("ℹ️ No notes found for %s to %s", startTime.Format(layout), endTime.Format(layout))
-			} else {
-				log.Printf("📦 Imported %d notes from %s to %s", batchImportedNotes, startTime.Format(layout), endTime.Format(layout))
+	if total.failed > 0 {
+		log.Printf("⚠️ Failed to import %d notes", total.failed)
+	}
+	log.Println("✅ owner note import complete! Imported", total.stored, "notes")
+}
+
+type importStats struct {
+	fetched int // unique events returned by the relay
+	stored  int // events first stored from this relay
+	failed  int // events that could not be stored
+	pages   int // requests made to the relay
+}
+
+func importOwnerNotesFromRelay(ctx context.Context, url string, authors []string, until nostr.Timestamp, cp *importCheckpoint, stored *xsync.Map[string, struct{}]) importStats {
+	var stats importStats
+	wdb := eventstore.RelayWrapper{Store: outboxDB}
+	window := nostr.Timestamp(importWindow.Seconds())
+	timeout := time.Duration(config.ImportOwnerNotesFetchTimeoutSeconds) * time.Second
+
+	start := cp.resumeFrom(url)
+	if start > cp.Since {
+		log.Printf("⏩ resuming import from %s at %s", url, start.Time().Format(layout))
+	}
+
+	for windowStart := start; windowStart < until; windowStart += window {
+		windowEnd := min(windowStart+window, until)
+
+		events, pages, err := fetchWindow(ctx, url, nostr.Filter{Authors: authors}, windowStart, windowEnd, timeout)
+		stats.pages += pages
+		if err != nil {
+			log.Printf("🚫 Giving up on %s after %d attempts at %s to %s: %v, run again with --resume to continue",
+				url, importMaxAttempts, windowStart.Time().Format(layout), windowEnd.Time().Format(layout), err)
+			return stats
+		}
+		stats.fetched += len(events)
+
+		batchImportedNotes := 0
+		for _, ev := range events {
+			if config.BlacklistedPubKeys.Has(ev.PubKey) {
+				slog.Debug("🚫 skipping event from blacklisted pubkey", "pubkey", ev.PubKey, "id", ev.ID)
+				continue
 			}
-		case <-ctx.Done():
-			log.Printf("🚫 Timeout after %v while importing notes from %s to %s", timeout, startTime.Format(layout), endTime.Format(layout))
+			if isExpired(ev, nostr.Now()) {
+				slog.Debug("⌛ skipping expired event", "id", ev.ID)
+				continue
+			}
+			if _, loaded := stored.LoadOrStore(ev.ID, struct{}{}); loaded {
+				continue
+			}
+			if err := wdb.Publish(ctx, *ev); err != nil {
+				log.Println("🚫  error importing note", ev.ID, ":", err)
+				stored.Delete(ev.ID)
+				stats.failed++
+				continue
+			}
+			batchImportedNotes++
 		}
+		stats.stored += batchImportedNotes
 
-		startTime = startTime.Add(240 * time.Hour)
-		endTime = endTime.Add(240 * time.Hour)
+		if len(events) == 0 {
+			slog.Debug("ℹ️ No notes found", "relay", url, "from", windowStart.Time().Format(layout), "to", windowEnd.Time().Format(layout))
+		} else {
+			log.Printf("📦 Imported %d new notes out of %d from %s, %s to %s",
+				batchImportedNotes, len(events), url, windowStart.Time().Format(layout), windowEnd.Time().Format(layout))
+		}
+		cp.complete(url, windowEnd)
+
+		time.Sleep(1 * time.Second) // Avoid bombarding relays with too many requests
+	}
 
-		if startTime.After(time.Now()) {
-			log.Println("✅ owner note import complete! Imported", ownerImportedNotes, "notes")
+	return stats
+}
+
+// fetchWindow fetches all events matching the filter created within a window from a relay. Relays
+// commonly cap the number of events per response, so the window is paged backwards with Until,
+// starting at the oldest event of the previous page, until a page brings nothing new. Each page
+// must arrive within timeout.
+func fetchWindow(ctx context.Context, url string, filter nostr.Filter, windowStart, windowEnd nostr.Timestamp, timeout time.Duration) ([]*nostr.Event, int, error) {
+	seen := make(map[string]struct{})
+	var events []*nostr.Event
+
+	pages := 0
+	pageUntil := windowEnd
+	for pageUntil >= windowStart {
+		filter.Since = &windowStart
+		filter.Until = &pageUntil
+		filter.Limit = importPageSize
+
+		page, err := fetchWithRetry(ctx, url, filter, timeout)
+		pages++
+		if err != nil {
+			return nil, pages, err
+		}
+		if len(page) == 0 {
 			break
 		}
-		if nFailedImportNotes > 0 {
-			log.Printf("⚠️ Failed to import %d notes", nFailedImportNotes)
+
+		oldest := pageUntil
+		newEvents := 0
+		for _, ev := range page {
+			oldest = min(oldest, ev.CreatedAt)
+			if _, ok := seen[ev.ID]; ok {
+				continue
+			}
+			seen[ev.ID] = struct{}{}
+			events = append(events, ev)
+			newEvents++
 		}
 
-		time.Sleep(1 * time.Second) // Avoid bombarding relays with too many requests
+		slog.Debug("📄 fetched page", "relay", url, "events", len(page), "new", newEvents, "until", pageUntil.Time())
+		if newEvents == 0 {
+			// Only events we already have at the boundary second: either the window is exhausted
+			// or more events share that second than the relay returns, skip past it.
+			pageUntil = oldest - 1
+			continue
+		}
+
+		// Until is inclusive: the next page starts at the oldest second seen, duplicates are skipped
+		pageUntil = oldest
+	}
+
+	return events, pages, nil
+}
+
+// fetchWithRetry queries a single relay until it signals the end of stored events, retrying
+// with exponential backoff when the connection fails, the relay closes the subscription or the
+// query times out.
+func fetchWithRetry(ctx context.Context, url string, filter nostr.Filter, timeout time.Duration) ([]*nostr.Event, error) {
+	backoff := importInitialBackoff
+	var err error
+	for attempt := 1; attempt <= importMaxAttempts; attempt++ {
+		var events []*nostr.Event
+		if events, err = fetchFromRelay(ctx, url, filter, timeout); err == nil {
+			return events, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt == importMaxAttempts {
+			break
+		}
+
+		slog.Warn("⚠️ fetch failed, retrying", "relay", url, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, importMaxBackoff)
 	}
+	return nil, err
 }
 
-func importTaggedNotes(ctx context.Context) {
+func fetchFromRelay(ctx context.Context, url string, filter nostr.Filter, timeout time.Duration) ([]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	relay, err := pool.EnsureRelay(url)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %w", err)
+	}
+
+	sub, err := relay.Subscribe(ctx, nostr.Filters{filter})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing: %w", err)
+	}
+	defer sub.Unsub()
+
+	var events []*nostr.Event
+	for {
+		select {
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return nil, fmt.Errorf("subscription ended before EOSE")
+			}
+			events = append(events, ev)
+		case <-sub.EndOfStoredEvents:
+			return events, nil
+		case reason := <-sub.ClosedReason:
+			return nil, fmt.Errorf("closed by relay: %s", reason)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout after %v", timeout)
+		}
+	}
+}
+
+func importTaggedNotes(ctx context.Context, relays []string) {
 	taggedImportedNotes := 0
 	done := make(chan struct{}, 1)
 	timeout := time.Duration(config.ImportTaggedNotesFetchTimeoutSeconds) * time.Second
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	wdbInbox := eventstore.RelayWrapper{Store: inboxDB}
-	wdbChat := eventstore.RelayWrapper{Store: chatDB}
 	filter := nostr.Filter{
 		Tags: nostr.TagMap{
-			"p": slices.Collect(maps.Keys(config.WhitelistedPubKeys)),
+			"p": config.WhitelistedPubKeys.Keys(),
 		},
 	}
 
-	log.Println("📦 importing inbox notes, please wait up to", timeout)
+	log.Println("📦 importing inbox notes from", len(relays), "relays, please wait up to", timeout)
 
 	go func() {
-		events := pool.FetchMany(ctx, config.ImportSeedRelays, filter)
+		events := pool.FetchMany(ctx, relays, filter)
 		for ev := range events {
 			if ctx.Err() != nil {
 				break // Stop the loop on timeout
 			}
 
-			if _, ok := config.BlacklistedPubKeys[ev.PubKey]; ok {
-				slog.Debug("🚫 skipping tagged event from blacklisted pubkey", "pubkey", ev.PubKey, "id", ev.ID)
-				continue
-			}
-
-			if !wot.GetInstance().Has(ctx, ev.PubKey) && ev.Kind != nostr.KindGiftWrap {
-				continue
-			}
-			for tag := range ev.Tags.FindAll("p") {
-				if len(tag) < 2 {
-					continue
-				}
-				if _, ok := config.WhitelistedPubKeys[tag[1]]; ok {
-					dbToWrite := wdbInbox
-					if ev.Kind == nostr.KindGiftWrap {
-						dbToWrite = wdbChat
-					}
-					if err := dbToWrite.Publish(ctx, *ev.Event); err != nil {
-						log.Println("🚫 error importing tagged note", ev.ID, ":", err)
-					}
-					taggedImportedNotes++
-				}
+			if storeTaggedEvent(ctx, ev.Event, ev.Relay.URL) {
+				taggedImportedNotes++
 			}
 		}
 		close(done)
@@ -206,13 +430,38 @@ func importTaggedNotes(ctx context.Context) {
 	log.Println("✅ tagged import complete")
 }
 
+// subscribeInboxAndChat keeps a subscription to notes tagging whitelisted pubkeys open,
+// re-subscribing with the new filter whenever the whitelist changes.
 func subscribeInboxAndChat(ctx context.Context) {
-	wdbInbox := eventstore.RelayWrapper{Store: inboxDB}
-	wdbChat := eventstore.RelayWrapper{Store: chatDB}
 	startTime := nostr.Timestamp(time.Now().Add(-time.Minute * 5).Unix())
+
+	for {
+		subCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			subscribeInboxAndChatSince(subCtx, startTime)
+		}()
+
+		select {
+		case <-ctx.Done():
+			cancel()
+			<-done
+			return
+		case <-whitelistChanged:
+			cancel()
+			<-done
+			// Overlap with the previous subscription, duplicates are skipped
+			startTime = nostr.Now() - 60
+			log.Println("🔄 whitelist changed, re-subscribing to inbox")
+		}
+	}
+}
+
+func subscribeInboxAndChatSince(ctx context.Context, startTime nostr.Timestamp) {
 	filter := nostr.Filter{
 		Tags: nostr.TagMap{
-			"p": slices.Collect(maps.Keys(config.WhitelistedPubKeys)),
+			"p": config.WhitelistedPubKeys.Keys(),
 		},
 		Since: &startTime,
 	}
@@ -220,56 +469,74 @@ func subscribeInboxAndChat(ctx context.Context) {
 	log.Println("📢 subscribing to inbox")
 
 	for ev := range pool.SubscribeMany(ctx, config.ImportSeedRelays, filter) {
-		if _, ok := config.BlacklistedPubKeys[ev.PubKey]; ok {
-			slog.Debug("🚫discarding imported note from blacklisted pubkey", "pubkey", ev.PubKey, "id", ev.ID)
+		if !storeTaggedEvent(ctx, ev.Event, ev.Relay.URL) {
+			continue
+		}
+
+		switch ev.Kind {
+		case nostr.KindTextNote:
+			log.Println("📰 new note in your inbox")
+		case nostr.KindReaction:
+			log.Println(ev.Content, "new reaction in your inbox")
+		case nostr.KindZap:
+			log.Println("⚡️ new zap in your inbox")
+		case nostr.KindEncryptedDirectMessage:
+			log.Println("🔒✉️ new encrypted message in your inbox")
+		case nostr.KindGiftWrap:
+			log.Println("🎁🔒️✉️ new gift-wrapped message in your chat relay")
+		case nostr.KindRepost:
+			log.Println("🔁 new repost in your inbox")
+		case nostr.KindFollowList:
+			// do nothing
+		default:
+			log.Println("📦 new event kind", ev.Kind, "event in your inbox")
+		}
+	}
+}
+
+// storeTaggedEvent saves an event fetched from the import relays to the inbox, or to the chat relay
+// if it is a gift wrap, as long as it tags a whitelisted pubkey, isn't NIP-70 protected, expired or
+// deleted by a request to vanish, and passes the blacklist and WoT checks.
+// It reports whether the event was stored.
+func storeTaggedEvent(ctx context.Context, ev *nostr.Event, relayURL string) bool {
+	if config.BlacklistedPubKeys.Has(ev.PubKey) {
+		slog.Debug("🚫discarding imported note from blacklisted pubkey", "pubkey", ev.PubKey, "id", ev.ID)
+		return false
+	}
+	if isProtected(ev) || vanishRequests.Covers(ev) || isExpired(ev, nostr.Now()) {
+		slog.Debug("🚫 discarding protected, vanished or expired imported note", "pubkey", ev.PubKey, "id", ev.ID)
+		return false
+	}
+	if !wot.GetInstance().Has(ctx, ev.PubKey) && ev.Kind != nostr.KindGiftWrap {
+		return false
+	}
+	for tag := range ev.Tags.FindAll("p") {
+		if len(tag) < 2 {
 			continue
 		}
-		if !wot.GetInstance().Has(ctx, ev.PubKey) && ev.Kind != nostr.KindGiftWrap {
+		if !config.WhitelistedPubKeys.Has(tag[1]) {
 			continue
 		}
-		for tag := range ev.Tags.FindAll("p") {
-			if len(tag) < 2 {
-				continue
-			}
-			if _, ok := config.WhitelistedPubKeys[tag[1]]; ok {
-				dbToPublish := wdbInbox
-				if ev.Kind == nostr.KindGiftWrap {
-					dbToPublish = wdbChat
-				}
-
-				slog.Debug("ℹ️ importing event", "kind", ev.Kind, "id", ev.ID, "relay", ev.Relay.URL)
-
-				if isDuplicate(ctx, dbToPublish, ev.Event) {
-					slog.Debug("ℹ️ skipping duplicate event", "id", ev.ID)
-					break // Avoid re-importing duplicates
-				}
-
-				if err := dbToPublish.Publish(ctx, *ev.Event); err != nil {
-					log.Println("🚫 error importing tagged note", ev.ID, ":", "from relay", ev.Relay.URL, ":", err)
-					break
-				}
-
-				switch ev.Kind {
-				case nostr.KindTextNote:
-					log.Println("📰 new note in your inbox")
-				case nostr.KindReaction:
-					log.Println(ev.Content, "new reaction in your inbox")
-				case nostr.KindZap:
-					log.Println("⚡️ new zap in your inbox")
-				case nostr.KindEncryptedDirectMessage:
-					log.Println("🔒✉️ new encrypted message in your inbox")
-				case nostr.KindGiftWrap:
-					log.Println("🎁🔒️✉️ new gift-wrapped message in your chat relay")
-				case nostr.KindRepost:
-					log.Println("🔁 new repost in your inbox")
-				case nostr.KindFollowList:
-					// do nothing
-				default:
-					log.Println("📦 new event kind", ev.Kind, "event in your inbox")
-				}
-			}
+
+		dbToPublish := eventstore.RelayWrapper{Store: inboxDB}
+		if ev.Kind == nostr.KindGiftWrap {
+			dbToPublish = eventstore.RelayWrapper{Store: chatDB}
+		}
+
+		slog.Debug("ℹ️ importing event", "kind", ev.Kind, "id", ev.ID, "relay", relayURL)
+
+		if isDuplicate(ctx, dbToPublish, ev) {
+			slog.Debug("ℹ️ skipping duplicate event", "id", ev.ID)
+			return false // Avoid re-importing duplicates
+		}
+
+		if err := dbToPublish.Publish(ctx, *ev); err != nil {
+			log.Println("🚫 error importing tagged note", ev.ID, ":", "from relay", relayURL, ":", err)
+			return false
 		}
+		return true
 	}
+	return false
 }
 
 func isDuplicate(ctx context.Context, db eventstore.RelayWrapper, event *nostr.Event) bool {
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const importCheckpointStateName = "import_checkpoint"
+
+// importCheckpoint records, for each seed relay, the end of the last time window whose owner
+// notes were fully imported, so an interrupted `haven import` can pick up where it left off.
+type importCheckpoint struct {
+	mu sync.Mutex
+
+	Since  nostr.Timestamp            `json:"since"`
+	Relays map[string]nostr.Timestamp `json:"relays"`
+}
+
+// loadImportCheckpoint returns the saved checkpoint if it covers an import starting at since,
+// or a fresh one otherwise.
+func loadImportCheckpoint(since nostr.Timestamp) *importCheckpoint {
+	cp := &importCheckpoint{}
+	if err := loadState(importCheckpointStateName, cp); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("⚠️ unable to load import checkpoint, starting over", "error", err)
+		}
+		return newImportCheckpoint(since)
+	}
+	if cp.Since != since {
+		slog.Warn("⚠️ import checkpoint was saved for a different start date, starting over",
+			"checkpoint", cp.Since.Time().Format(layout), "since", since.Time().Format(layout))
+		return newImportCheckpoint(since)
+	}
+	if cp.Relays == nil {
+		cp.Relays = make(map[string]nostr.Timestamp)
+	}
+	return cp
+}
+
+func newImportCheckpoint(since nostr.Timestamp) *importCheckpoint {
+	return &importCheckpoint{
+		Since:  since,
+		Relays: make(map[string]nostr.Timestamp),
+	}
+}
+
+// resumeFrom returns where the import from the given relay should continue.
+func (cp *importCheckpoint) resumeFrom(relay string) nostr.Timestamp {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if done, ok := cp.Relays[relay]; ok && done > cp.Since {
+		return done
+	}
+	return cp.Since
+}
+
+// complete marks every window up to windowEnd as imported for the relay and persists the checkpoint.
+func (cp *importCheckpoint) complete(relay string, windowEnd nostr.Timestamp) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Relays[relay] = windowEnd
+	if err := saveState(importCheckpointStateName, cp); err != nil {
+		slog.Error("🚫 error saving import checkpoint", "error", err)
+	}
+}
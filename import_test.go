@@ -0,0 +1,126 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupTestRelay serves a relay keeping the events in memory, which returns at most maxLimit
+// events per query like most public relays do. It returns the websocket URL of the relay.
+func setupTestRelay(t *testing.T, maxLimit int, events []*nostr.Event) string {
+	t.Helper()
+	events = slices.Clone(events)
+	slices.SortFunc(events, func(a, b *nostr.Event) int { return cmp.Compare(b.CreatedAt, a.CreatedAt) })
+
+	relay := khatru.NewRelay()
+	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			sent := 0
+			for _, ev := range events {
+				if sent == filter.Limit {
+					return
+				}
+				if !filter.Matches(ev) {
+					continue
+				}
+				select {
+				case ch <- ev:
+					sent++
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch, nil
+	})
+	relay.OverwriteFilter = append(relay.OverwriteFilter, MaxFilterLimit(maxLimit))
+	srv := httptest.NewServer(relay)
+	t.Cleanup(srv.Close)
+
+	oldPool := pool
+	poolCtx, cancel := context.WithCancel(context.Background())
+	pool = nostr.NewSimplePool(poolCtx)
+	t.Cleanup(func() {
+		cancel()
+		pool = oldPool
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// signedNotes returns count notes of the key, created perSecond at a time going back from until.
+func signedNotes(t *testing.T, sk string, count, perSecond int, until nostr.Timestamp) []*nostr.Event {
+	t.Helper()
+	events := make([]*nostr.Event, 0, count)
+	for i := range count {
+		ev := &nostr.Event{
+			Kind:      nostr.KindTextNote,
+			CreatedAt: until - nostr.Timestamp(i/perSecond),
+			Content:   "note " + strconv.Itoa(i),
+		}
+		if err := ev.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestFetchWindow(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	windowEnd := nostr.Timestamp(1_700_000_000)
+
+	tests := []struct {
+		name      string
+		maxLimit  int
+		count     int
+		perSecond int
+	}{
+		{"fits in one page", 500, 120, 1},
+		{"relay caps below the page size", 100, 350, 1},
+		{"pages end inside a second", 100, 350, 3},
+		{"relay caps at 300", 300, 1000, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes := signedNotes(t, sk, tt.count, tt.perSecond, windowEnd)
+			windowStart := notes[len(notes)-1].CreatedAt
+			// Events outside the window are left out
+			outside := signedNotes(t, sk, 5, 1, windowStart-1)
+			url := setupTestRelay(t, tt.maxLimit, append(notes, outside...))
+
+			events, pages, err := fetchWindow(context.Background(), url, nostr.Filter{Authors: []string{pubkey}},
+				windowStart, windowEnd, 5*time.Second)
+			if err != nil {
+				t.Fatalf("fetchWindow: %v", err)
+			}
+			if len(events) != tt.count {
+				t.Errorf("fetched %d events in %d pages, want %d", len(events), pages, tt.count)
+			}
+			if minPages := (tt.count + tt.maxLimit - 1) / tt.maxLimit; pages < minPages {
+				t.Errorf("fetched in %d pages, want at least %d", pages, minPages)
+			}
+			want := make(map[string]struct{}, len(notes))
+			for _, ev := range notes {
+				want[ev.ID] = struct{}{}
+			}
+			for _, ev := range events {
+				if _, ok := want[ev.ID]; !ok {
+					t.Errorf("fetched unexpected event created at %d", ev.CreatedAt)
+				}
+				delete(want, ev.ID)
+			}
+		})
+	}
+}
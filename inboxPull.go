@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const inboxPullStateName = "inbox_pull"
+
+type inboxPullState struct {
+	// LastPull is the last successful pull of all relays, before progress was saved per relay
+	LastPull nostr.Timestamp            `json:"last_pull,omitempty"`
+	Relays   map[string]nostr.Timestamp `json:"relays,omitempty"`
+}
+
+// periodicInboxPull backfills the inbox and chat relays from the import relays every
+// INBOX_PULL_INTERVAL_SECONDS, starting from the last successful pull. It complements the live
+// subscription in subscribeInboxAndChat, catching up on whatever was missed while Haven was down
+// or disconnected.
+func periodicInboxPull(ctx context.Context) {
+	if config.InboxPullIntervalSeconds <= 0 {
+		slog.Info("ℹ️ periodic inbox pull disabled")
+		return
+	}
+	interval := time.Duration(config.InboxPullIntervalSeconds) * time.Second
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pullInbox(ctx, interval); err != nil {
+			slog.Error("🚫 inbox pull failed, will retry on next run", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pullInbox fetches the notes tagging a whitelisted pubkey from every import relay concurrently,
+// each from its own last successful pull, paging like the import does. A relay that fails keeps
+// its progress and is caught up on the next run, it only fails the pull if every relay does.
+func pullInbox(ctx context.Context, interval time.Duration) error {
+	var state inboxPullState
+	if err := loadState(inboxPullStateName, &state); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	until := nostr.Now()
+	filter := nostr.Filter{
+		Tags: nostr.TagMap{
+			"p": config.WhitelistedPubKeys.Keys(),
+		},
+	}
+	timeout := time.Duration(config.ImportTaggedNotesFetchTimeoutSeconds) * time.Second
+
+	lastPulls := make(map[string]nostr.Timestamp, len(config.ImportSeedRelays))
+	for _, url := range config.ImportSeedRelays {
+		lastPull, ok := state.Relays[url]
+		if !ok {
+			lastPull = state.LastPull
+		}
+		if lastPull == 0 {
+			// First run for this relay: older notes are brought in by `haven import`
+			lastPull = until - nostr.Timestamp(interval.Seconds())
+		}
+		lastPulls[url] = lastPull
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		relays  = maps.Clone(lastPulls)
+		fetched int
+		stored  int
+		failed  int
+	)
+	for url, lastPull := range lastPulls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Overlap with the previous pull to make up for clock skew, duplicates are skipped
+			since := lastPull - 60
+			slog.Debug("📥 pulling inbox", "relay", url, "since", since.Time(), "until", until.Time())
+
+			events, _, err := fetchWindow(ctx, url, filter, since, until, timeout)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Warn("⚠️ inbox pull failed for relay, will retry on next run", "relay", url, "since", since.Time(), "error", err)
+				failed++
+				return
+			}
+			fetched += len(events)
+			for _, ev := range events {
+				if storeTaggedEvent(ctx, ev, url) {
+					stored++
+				}
+			}
+			relays[url] = until
+		}()
+	}
+	wg.Wait()
+
+	state = inboxPullState{Relays: relays}
+	if err := saveState(inboxPullStateName, state); err != nil {
+		return fmt.Errorf("error saving inbox pull state: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if stored > 0 {
+		log.Printf("📥 pulled %d new notes into your inbox", stored)
+	}
+	if failed > 0 && failed == len(config.ImportSeedRelays) {
+		return fmt.Errorf("no import relay could be pulled")
+	}
+	slog.Debug("✅ inbox pull complete", "fetched", fetched, "stored", stored, "failed_relays", failed)
+	return nil
+}
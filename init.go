@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"log"
 	"log/slog"
+	"mime"
 	"net/http"
 	"text/template"
 	"time"
@@ -15,36 +17,73 @@ import (
 	"github.com/fiatjaf/khatru/blossom"
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 )
 
 var (
 	privateRelay = khatru.NewRelay()
-	privateDB    = newDBBackend("db/private")
+	privateDB    DBBackend
 )
 
 var (
 	chatRelay = khatru.NewRelay()
-	chatDB    = newDBBackend("db/chat")
+	chatDB    DBBackend
 )
 
 var (
 	outboxRelay = khatru.NewRelay()
-	outboxDB    = newDBBackend("db/outbox")
+	outboxDB    DBBackend
 )
 
 var (
 	inboxRelay = khatru.NewRelay()
-	inboxDB    = newDBBackend("db/inbox")
+	inboxDB    DBBackend
 )
 
-var blossomDB = newDBBackend("db/blossom")
+var blossomDB DBBackend
 
-var dbs = map[string]DBBackend{
-	"blossom": blossomDB,
-	"chat":    chatDB,
-	"inbox":   inboxDB,
-	"outbox":  outboxDB,
-	"private": privateDB,
+var accessDB DBBackend
+
+// kindPolicies holds the kinds accepted by each relay, built from the relay limits.
+var kindPolicies map[string]*KindPolicy
+
+func initKindPolicies() {
+	kindPolicies = map[string]*KindPolicy{
+		"private": NewKindPolicy(privateRelayLimits.AllowedKinds, privateRelayLimits.DeniedKinds),
+		"chat":    NewKindPolicy(chatRelayLimits.AllowedKinds, chatRelayLimits.DeniedKinds),
+		"outbox":  NewKindPolicy(outboxRelayLimits.AllowedKinds, outboxRelayLimits.DeniedKinds),
+		"inbox":   NewKindPolicy(inboxRelayLimits.AllowedKinds, inboxRelayLimits.DeniedKinds),
+	}
+}
+
+// dbs are all the databases by name, as they are named in backups.
+var dbs map[string]DBBackend
+
+// newDBBackends sets up the databases with the engine chosen in the configuration, which must be
+// loaded first. They are opened by initDBs.
+func newDBBackends() {
+	privateDB = newDBBackend("db/private")
+	chatDB = newDBBackend("db/chat")
+	outboxDB = newDBBackend("db/outbox")
+	inboxDB = newDBBackend("db/inbox")
+	blossomDB = newDBBackend("db/blossom")
+	accessDB = newDBBackend("db/access")
+
+	dbs = map[string]DBBackend{
+		"access":  accessDB,
+		"blossom": blossomDB,
+		"chat":    chatDB,
+		"inbox":   inboxDB,
+		"outbox":  outboxDB,
+		"private": privateDB,
+	}
+	eventDBs = map[string]DBBackend{
+		"chat":    chatDB,
+		"inbox":   inboxDB,
+		"outbox":  outboxDB,
+		"private": privateDB,
+	}
+	accessStore = AccessStore{DBBackend: accessDB}
 }
 
 type DBBackend interface {
@@ -98,12 +137,22 @@ func initDBs() {
 	if err := blossomDB.Init(); err != nil {
 		panic(err)
 	}
+
+	if err := accessDB.Init(); err != nil {
+		panic(err)
+	}
 }
 
-func initRelays(ctx context.Context) {
-	initDBs()
+func closeDBs() {
+	for name, db := range dbs {
+		slog.Debug("🔒 closing database", "name", name)
+		db.Close()
+	}
+}
 
+func initRelays(ctx context.Context) {
 	initRelayLimits()
+	initKindPolicies()
 
 	privateRelay.Info.Name = config.PrivateRelayName
 	privateRelay.Info.PubKey = nPubToPubkey(config.PrivateRelayNpub)
@@ -111,6 +160,17 @@ func initRelays(ctx context.Context) {
 	privateRelay.Info.Icon = config.PrivateRelayIcon
 	privateRelay.Info.Version = config.RelayVersion
 	privateRelay.Info.Software = config.RelaySoftware
+	privateRelay.Info.RelayCountries = config.RelayCountries
+	privateRelay.Info.LanguageTags = config.RelayLanguageTags
+	privateRelay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: privateRelayLimits.MaxMessageLength,
+		MaxLimit:         privateRelayLimits.MaxLimit,
+		AuthRequired:     true,
+		RestrictedWrites: true,
+	}
+	privateRelay.Info.AddSupportedNIPs([]int{9, 62, 86})
+	privateRelay.Info.Retention = privateRelayLimits.Retention.Documents()
+	privateRelay.MaxMessageSize = int64(privateRelayLimits.MaxMessageLength)
 	privateRelay.ServiceURL = "https://" + config.RelayURL + "/private"
 
 	if !privateRelayLimits.AllowEmptyFilters {
@@ -119,6 +179,9 @@ func initRelays(ctx context.Context) {
 	if !privateRelayLimits.AllowComplexFilters {
 		privateRelay.RejectFilter = append(privateRelay.RejectFilter, policies.NoComplexFilters)
 	}
+	if privateRelayLimits.MaxLimit > 0 {
+		privateRelay.OverwriteFilter = append(privateRelay.OverwriteFilter, MaxFilterLimit(privateRelayLimits.MaxLimit))
+	}
 	privateRelay.RejectFilter = append(privateRelay.RejectFilter, policies.MustAuth, MustBeWhitelistedToQuery)
 
 	privateRelay.RejectEvent = append(privateRelay.RejectEvent,
@@ -128,7 +191,11 @@ func initRelays(ctx context.Context) {
 			time.Minute*time.Duration(privateRelayLimits.EventIPLimiterInterval),
 			privateRelayLimits.EventIPLimiterMaxTokens,
 		),
+		MustBePublishedByAuthorIfProtected,
+		HonourVanishRequests,
+		RejectExpiredEvents,
 		MustBeWhitelistedToPost,
+		kindPolicies["private"].RejectEvent,
 	)
 
 	privateRelay.RejectConnection = append(privateRelay.RejectConnection,
@@ -142,10 +209,11 @@ func initRelays(ctx context.Context) {
 	privateRelay.OnConnect = append(privateRelay.OnConnect, khatru.RequestAuth)
 
 	privateRelay.StoreEvent = append(privateRelay.StoreEvent, privateDB.SaveEvent)
-	privateRelay.QueryEvents = append(privateRelay.QueryEvents, privateDB.QueryEvents)
+	privateRelay.QueryEvents = append(privateRelay.QueryEvents, WithoutExpiredEvents(privateDB.QueryEvents))
 	privateRelay.DeleteEvent = append(privateRelay.DeleteEvent, privateDB.DeleteEvent)
 	privateRelay.CountEvents = append(privateRelay.CountEvents, privateDB.CountEvents)
 	privateRelay.ReplaceEvent = append(privateRelay.ReplaceEvent, privateDB.ReplaceEvent)
+	privateRelay.OnEventSaved = append(privateRelay.OnEventSaved, applyDeletions(ctx, "private"))
 
 	mux := privateRelay.Router()
 
@@ -174,6 +242,17 @@ func initRelays(ctx context.Context) {
 	chatRelay.Info.Icon = config.ChatRelayIcon
 	chatRelay.Info.Version = config.RelayVersion
 	chatRelay.Info.Software = config.RelaySoftware
+	chatRelay.Info.RelayCountries = config.RelayCountries
+	chatRelay.Info.LanguageTags = config.RelayLanguageTags
+	chatRelay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: chatRelayLimits.MaxMessageLength,
+		MaxLimit:         chatRelayLimits.MaxLimit,
+		AuthRequired:     true,
+		RestrictedWrites: true,
+	}
+	chatRelay.Info.AddSupportedNIPs([]int{9, 17, 59, 62, 86})
+	chatRelay.Info.Retention = chatRelayLimits.Retention.Documents()
+	chatRelay.MaxMessageSize = int64(chatRelayLimits.MaxMessageLength)
 	chatRelay.ServiceURL = "https://" + config.RelayURL + "/chat"
 
 	if !chatRelayLimits.AllowEmptyFilters {
@@ -182,6 +261,9 @@ func initRelays(ctx context.Context) {
 	if !chatRelayLimits.AllowComplexFilters {
 		chatRelay.RejectFilter = append(chatRelay.RejectFilter, policies.NoComplexFilters)
 	}
+	if chatRelayLimits.MaxLimit > 0 {
+		chatRelay.OverwriteFilter = append(chatRelay.OverwriteFilter, MaxFilterLimit(chatRelayLimits.MaxLimit))
+	}
 	chatRelay.RejectFilter = append(chatRelay.RejectFilter, policies.MustAuth, MustBeInWotToQuery)
 
 	chatRelay.RejectEvent = append(chatRelay.RejectEvent,
@@ -191,9 +273,12 @@ func initRelays(ctx context.Context) {
 			time.Minute*time.Duration(chatRelayLimits.EventIPLimiterInterval),
 			chatRelayLimits.EventIPLimiterMaxTokens,
 		),
+		MustBePublishedByAuthorIfProtected,
+		HonourVanishRequests,
+		RejectExpiredEvents,
 		MustNotBeBlacklistedToPost,
 		MustBeInWotToPost,
-		EventMustBeChatRelated,
+		kindPolicies["chat"].RejectEvent,
 	)
 
 	chatRelay.RejectConnection = append(chatRelay.RejectConnection,
@@ -207,10 +292,11 @@ func initRelays(ctx context.Context) {
 	chatRelay.OnConnect = append(chatRelay.OnConnect, khatru.RequestAuth)
 
 	chatRelay.StoreEvent = append(chatRelay.StoreEvent, chatDB.SaveEvent)
-	chatRelay.QueryEvents = append(chatRelay.QueryEvents, chatDB.QueryEvents)
+	chatRelay.QueryEvents = append(chatRelay.QueryEvents, WithoutExpiredEvents(chatDB.QueryEvents))
 	chatRelay.DeleteEvent = append(chatRelay.DeleteEvent, chatDB.DeleteEvent)
 	chatRelay.CountEvents = append(chatRelay.CountEvents, chatDB.CountEvents)
 	chatRelay.ReplaceEvent = append(chatRelay.ReplaceEvent, chatDB.ReplaceEvent)
+	chatRelay.OnEventSaved = append(chatRelay.OnEventSaved, applyDeletions(ctx, "chat"))
 
 	mux = chatRelay.Router()
 
@@ -239,6 +325,17 @@ func initRelays(ctx context.Context) {
 	outboxRelay.Info.Icon = config.OutboxRelayIcon
 	outboxRelay.Info.Version = config.RelayVersion
 	outboxRelay.Info.Software = config.RelaySoftware
+	outboxRelay.Info.RelayCountries = config.RelayCountries
+	outboxRelay.Info.LanguageTags = config.RelayLanguageTags
+	outboxRelay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: outboxRelayLimits.MaxMessageLength,
+		MaxLimit:         outboxRelayLimits.MaxLimit,
+		AuthRequired:     false,
+		RestrictedWrites: true,
+	}
+	outboxRelay.Info.AddSupportedNIPs([]int{9, 62, 86})
+	outboxRelay.Info.Retention = outboxRelayLimits.Retention.Documents()
+	outboxRelay.MaxMessageSize = int64(outboxRelayLimits.MaxMessageLength)
 	outboxRelay.ServiceURL = "https://" + config.RelayURL
 
 	if !outboxRelayLimits.AllowEmptyFilters {
@@ -247,6 +344,9 @@ func initRelays(ctx context.Context) {
 	if !outboxRelayLimits.AllowComplexFilters {
 		outboxRelay.RejectFilter = append(outboxRelay.RejectFilter, policies.NoComplexFilters)
 	}
+	if outboxRelayLimits.MaxLimit > 0 {
+		outboxRelay.OverwriteFilter = append(outboxRelay.OverwriteFilter, MaxFilterLimit(outboxRelayLimits.MaxLimit))
+	}
 
 	outboxRelay.RejectEvent = append(outboxRelay.RejectEvent,
 		policies.RejectEventsWithBase64Media,
@@ -255,7 +355,11 @@ func initRelays(ctx context.Context) {
 			time.Minute*time.Duration(outboxRelayLimits.EventIPLimiterInterval),
 			outboxRelayLimits.EventIPLimiterMaxTokens,
 		),
+		MustBePublishedByAuthorIfProtected,
+		HonourVanishRequests,
+		RejectExpiredEvents,
 		MustBeWhitelistedToPost,
+		kindPolicies["outbox"].RejectEvent,
 	)
 
 	outboxRelay.RejectConnection = append(outboxRelay.RejectConnection,
@@ -266,14 +370,16 @@ func initRelays(ctx context.Context) {
 		),
 	)
 
-	outboxRelay.StoreEvent = append(outboxRelay.StoreEvent, outboxDB.SaveEvent, func(ctx context.Context, event *nostr.Event) error {
-		go blast(ctx, event)
+	outboxRelay.StoreEvent = append(outboxRelay.StoreEvent, outboxDB.SaveEvent, func(_ context.Context, event *nostr.Event) error {
+		// Use the main context rather than the client's, so the delivery outlives the connection
+		blast(ctx, event)
 		return nil
 	})
-	outboxRelay.QueryEvents = append(outboxRelay.QueryEvents, outboxDB.QueryEvents)
+	outboxRelay.QueryEvents = append(outboxRelay.QueryEvents, WithoutExpiredEvents(outboxDB.QueryEvents))
 	outboxRelay.DeleteEvent = append(outboxRelay.DeleteEvent, outboxDB.DeleteEvent)
 	outboxRelay.CountEvents = append(outboxRelay.CountEvents, outboxDB.CountEvents)
 	outboxRelay.ReplaceEvent = append(outboxRelay.ReplaceEvent, outboxDB.ReplaceEvent)
+	outboxRelay.OnEventSaved = append(outboxRelay.OnEventSaved, applyDeletions(ctx, "outbox"))
 
 	mux = outboxRelay.Router()
 
@@ -298,33 +404,47 @@ func initRelays(ctx context.Context) {
 	})
 
 	bl := blossom.New(outboxRelay, "https://"+config.RelayURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: blossomDB, ServiceURL: bl.ServiceURL}
+	blossomServer = bl
+	bl.Store = &usageTrackingIndex{
+		EventStoreBlobIndexWrapper: blossom.EventStoreBlobIndexWrapper{Store: blossomDB, ServiceURL: bl.ServiceURL},
+		usages:                     blobUsages,
+	}
+	if err := blobUsages.load(ctx, blossomDB); err != nil {
+		log.Fatal("🚫 error loading the Blossom storage usage:", err)
+	}
+	initBlobStorage()
 	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, ext string, body []byte) error {
 		slog.Debug("storing blob", "sha256", sha256, "ext", ext)
-		file, err := fs.Create(config.BlossomPath + sha256)
-		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(file, bytes.NewReader(body)); err != nil {
-			return err
-		}
-		return nil
+		return blobStorage.Store(ctx, sha256, bytes.NewReader(body), int64(len(body)), mime.TypeByExtension(ext))
 	})
 	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string, ext string) (io.ReadSeeker, error) {
 		slog.Debug("loading blob", "sha256", sha256, "ext", ext)
-		return fs.Open(config.BlossomPath + sha256)
+		blob, err := blobStorage.Load(ctx, sha256)
+		if err != nil {
+			return nil, err
+		}
+		// The Blossom server doesn't close the blobs it serves, so close them once the request is done
+		context.AfterFunc(ctx, func() { blob.Close() })
+		return blob, nil
 	})
 	bl.DeleteBlob = append(bl.DeleteBlob, func(ctx context.Context, sha256 string, ext string) error {
 		slog.Debug("deleting blob", "sha256", sha256, "ext", ext)
-		return fs.Remove(config.BlossomPath + sha256)
-	})
-	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, event *nostr.Event, size int, ext string) (bool, string, int) {
-		if _, ok := config.WhitelistedPubKeys[event.PubKey]; ok {
-			return false, ext, size
-		}
-
-		return true, "only media signed by whitelisted pubkeys are allowed", 403
+		return blobStorage.Delete(ctx, sha256)
 	})
+	bl.RejectUpload = append(bl.RejectUpload, RejectUploadNotWhitelisted, RejectUploadOverMaxSize, RejectUploadOverQuota)
+	mux = outboxRelay.Router()
+	mux.HandleFunc("PUT /upload", handleUpload(bl))
+	mux.HandleFunc("PUT /mirror", handleMirror(bl))
+	if config.BlossomMedia.Enabled {
+		mux.HandleFunc("HEAD /media", handleMediaCheck(bl))
+		mux.HandleFunc("PUT /media", handleMedia(bl))
+	}
+	// The Blossom server only recognises blob paths within its catch-all route, so blob downloads
+	// are routed before it
+	blobMux := http.NewServeMux()
+	blobMux.Handle("/", mux)
+	blobMux.HandleFunc("GET /{blob}", handleGetBlob(bl, mux))
+	outboxRelay.SetRouter(blobMux)
 	migrateBlossomMetadata(ctx, bl)
 
 	inboxRelay.Info.Name = config.InboxRelayName
@@ -333,6 +453,17 @@ func initRelays(ctx context.Context) {
 	inboxRelay.Info.Icon = config.InboxRelayIcon
 	inboxRelay.Info.Version = config.RelayVersion
 	inboxRelay.Info.Software = config.RelaySoftware
+	inboxRelay.Info.RelayCountries = config.RelayCountries
+	inboxRelay.Info.LanguageTags = config.RelayLanguageTags
+	inboxRelay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: inboxRelayLimits.MaxMessageLength,
+		MaxLimit:         inboxRelayLimits.MaxLimit,
+		AuthRequired:     false,
+		RestrictedWrites: true,
+	}
+	inboxRelay.Info.AddSupportedNIPs([]int{9, 62, 86})
+	inboxRelay.Info.Retention = inboxRelayLimits.Retention.Documents()
+	inboxRelay.MaxMessageSize = int64(inboxRelayLimits.MaxMessageLength)
 	inboxRelay.ServiceURL = "https://" + config.RelayURL + "/inbox"
 
 	if !inboxRelayLimits.AllowEmptyFilters {
@@ -341,6 +472,9 @@ func initRelays(ctx context.Context) {
 	if !inboxRelayLimits.AllowComplexFilters {
 		inboxRelay.RejectFilter = append(inboxRelay.RejectFilter, policies.NoComplexFilters)
 	}
+	if inboxRelayLimits.MaxLimit > 0 {
+		inboxRelay.OverwriteFilter = append(inboxRelay.OverwriteFilter, MaxFilterLimit(inboxRelayLimits.MaxLimit))
+	}
 
 	inboxRelay.RejectEvent = append(inboxRelay.RejectEvent,
 		policies.RejectEventsWithBase64Media,
@@ -349,10 +483,14 @@ func initRelays(ctx context.Context) {
 			time.Minute*time.Duration(inboxRelayLimits.EventIPLimiterInterval),
 			inboxRelayLimits.EventIPLimiterMaxTokens,
 		),
+		MustBePublishedByAuthorIfProtected,
+		HonourVanishRequests,
+		RejectExpiredEvents,
 		OnlyGiftWrappedDMs,
 		MustNotBeBlacklistedToPost,
 		MustBeInWotToPost,
 		MustTagWhitelistedPubKey,
+		kindPolicies["inbox"].RejectEvent,
 	)
 
 	inboxRelay.RejectConnection = append(inboxRelay.RejectConnection,
@@ -364,10 +502,11 @@ func initRelays(ctx context.Context) {
 	)
 
 	inboxRelay.StoreEvent = append(inboxRelay.StoreEvent, inboxDB.SaveEvent)
-	inboxRelay.QueryEvents = append(inboxRelay.QueryEvents, inboxDB.QueryEvents)
+	inboxRelay.QueryEvents = append(inboxRelay.QueryEvents, WithoutExpiredEvents(inboxDB.QueryEvents))
 	inboxRelay.DeleteEvent = append(inboxRelay.DeleteEvent, inboxDB.DeleteEvent)
 	inboxRelay.CountEvents = append(inboxRelay.CountEvents, inboxDB.CountEvents)
 	inboxRelay.ReplaceEvent = append(inboxRelay.ReplaceEvent, inboxDB.ReplaceEvent)
+	inboxRelay.OnEventSaved = append(inboxRelay.OnEventSaved, applyDeletions(ctx, "inbox"))
 
 	mux = inboxRelay.Router()
 
@@ -390,4 +529,12 @@ func initRelays(ctx context.Context) {
 		}
 	})
 
+	setupManagementAPI(ctx, "private", privateRelay, privateDB, kindPolicies["private"])
+	setupManagementAPI(ctx, "chat", chatRelay, chatDB, kindPolicies["chat"])
+	setupManagementAPI(ctx, "outbox", outboxRelay, outboxDB, kindPolicies["outbox"])
+	setupManagementAPI(ctx, "inbox", inboxRelay, inboxDB, kindPolicies["inbox"])
+
+	for _, relay := range []*khatru.Relay{privateRelay, chatRelay, outboxRelay, inboxRelay} {
+		connections.track(relay)
+	}
 }
@@ -20,3 +20,15 @@ type Provider interface {
 	Uploader
 	Downloader
 }
+
+// Storage is a Provider that can also be used to keep files, rather than just archive them.
+type Storage interface {
+	Provider
+	// Open returns the object, which can be seeked. It fails with an error wrapping os.ErrNotExist if there is
+	// no such object.
+	Open(ctx context.Context, bucketName string, objectName string) (io.ReadSeekCloser, error)
+	Exists(ctx context.Context, bucketName string, objectName string) (bool, error)
+	Delete(ctx context.Context, bucketName string, objectName string) error
+	// List calls fn with the name of every object starting with prefix.
+	List(ctx context.Context, bucketName string, prefix string, fn func(objectName string) error) error
+}
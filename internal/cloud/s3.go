@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -13,11 +15,15 @@ type GenericS3Provider struct {
 	client *minio.Client
 }
 
+// NewGenericS3Provider connects to an S3 compatible endpoint over HTTPS, unless the endpoint starts with
+// "http://", which is useful for testing against a local server.
 func NewGenericS3Provider(endpoint, accessKey, secret, region string) (*GenericS3Provider, error) {
+	endpoint, insecure := strings.CutPrefix(endpoint, "http://")
+	endpoint = strings.TrimPrefix(endpoint, "https://")
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secret, ""),
 		Region: region,
-		Secure: true,
+		Secure: !insecure,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create s3 client: %w", err)
@@ -54,3 +60,61 @@ func (s *GenericS3Provider) Download(ctx context.Context, bucketName string, obj
 
 	return reader, nil
 }
+
+func (s *GenericS3Provider) Open(ctx context.Context, bucketName string, objectName string) (io.ReadSeekCloser, error) {
+	object, err := s.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object from s3: %w", err)
+	}
+	// GetObject doesn't make any request until the object is read, so check it exists now
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if isNotFound(err) {
+			return nil, fmt.Errorf("object %s not found in s3: %w", objectName, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to open object from s3: %w", err)
+	}
+
+	return object, nil
+}
+
+func (s *GenericS3Provider) Exists(ctx context.Context, bucketName string, objectName string) (bool, error) {
+	_, err := s.client.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat object in s3: %w", err)
+	}
+
+	return true, nil
+}
+
+func (s *GenericS3Provider) Delete(ctx context.Context, bucketName string, objectName string) error {
+	if err := s.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete object from s3: %w", err)
+	}
+
+	return nil
+}
+
+func (s *GenericS3Provider) List(ctx context.Context, bucketName string, prefix string, fn func(objectName string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list objects in s3: %w", object.Err)
+		}
+		if err := fn(object.Key); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
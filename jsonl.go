@@ -19,26 +19,50 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func (z *zipWriter) close() {
-	if err := z.w.Close(); err != nil {
-		slog.Error("❌ error closing zip writer", "error", err)
-	}
-	if err := z.f.Close(); err != nil {
-		slog.Error("❌ error closing zip file", "error", err)
-	}
+func (z *zipWriter) close() error {
+	return errors.Join(z.w.Close(), z.f.Close())
 }
 
+// exportToZip backs up the databases. The media files are backed up apart, by exportMedia.
 func exportToZip(ctx context.Context, zipFileName string) error {
 	slog.Info("🛫 starting export", "file", zipFileName)
-	f, err := os.Create(zipFileName)
+	err := writeZipFile(zipFileName, func(zw *zip.Writer) error {
+		return writeZip(ctx, zw)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("✅ export complete", "file", zipFileName)
+	return nil
+}
+
+// writeZipFile writes a zip to a temporary file, which only replaces zipFileName once it is complete.
+func writeZipFile(zipFileName string, write func(zw *zip.Writer) error) error {
+	tmpFileName := zipFileName + ".tmp"
+	f, err := os.Create(tmpFileName)
 	if err != nil {
 		return fmt.Errorf("error creating zip file: %w", err)
 	}
 
-	zw := zip.NewWriter(f)
-	z := &zipWriter{f: f, w: zw}
-	defer z.close()
+	z := &zipWriter{f: f, w: zip.NewWriter(f)}
+	err = write(z.w)
+	if closeErr := z.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing zip file: %w", closeErr)
+	}
+	if err != nil {
+		if err := os.Remove(tmpFileName); err != nil {
+			slog.Error("❌ error deleting incomplete zip file", "file", tmpFileName, "error", err)
+		}
+		return err
+	}
+	if err := os.Rename(tmpFileName, zipFileName); err != nil {
+		return fmt.Errorf("error replacing zip file: %w", err)
+	}
+	return nil
+}
 
+func writeZip(ctx context.Context, zw *zip.Writer) error {
 	for name, db := range dbs {
 		fileName := name + ".jsonl"
 		slog.Info("📦 exporting db to fileName", "fileName", fileName)
@@ -58,8 +82,6 @@ func exportToZip(ctx context.Context, zipFileName string) error {
 			return fmt.Errorf("error exporting %s: %w", fileName, err)
 		}
 	}
-
-	slog.Info("✅ export complete", "file", zipFileName)
 	return nil
 }
 
@@ -186,6 +208,11 @@ func importDB(ctx context.Context, db DBBackend, r io.Reader) error {
 			return err
 		}
 
+		if isExpired(&event, nostr.Now()) {
+			slog.Debug("⌛ skipping expired event", "id", event.ID)
+			continue
+		}
+
 		if err := db.SaveEvent(ctx, &event); err != nil {
 			if errors.Is(err, eventstore.ErrDupEvent) {
 				slog.Debug("⏭️ skipping duplicate event", "id", event.ID)
@@ -210,6 +237,9 @@ func exportDB(ctx context.Context, db DBBackend, w io.Writer) error {
 	count := 0
 
 	var eventBuffer []*nostr.Event
+	// Expired events that weren't purged yet are left out of the export
+	now := nostr.Now()
+	expired := make(map[string]struct{})
 
 	flushBuffer := func() error {
 		for _, e := range eventBuffer {
@@ -237,8 +267,15 @@ func exportDB(ctx context.Context, db DBBackend, w io.Writer) error {
 
 		initialCount := count
 		initialBufferSize := len(eventBuffer)
+		initialExpired := len(expired)
 
 		for event := range events {
+			if isExpired(event, now) {
+				expired[event.ID] = struct{}{}
+				lastTimestamp = event.CreatedAt
+				continue
+			}
+
 			if len(eventBuffer) > 0 && event.CreatedAt != eventBuffer[0].CreatedAt {
 				if err := flushBuffer(); err != nil {
 					return err
@@ -267,7 +304,7 @@ func exportDB(ctx context.Context, db DBBackend, w io.Writer) error {
 			lastTimestamp = event.CreatedAt
 		}
 
-		if count == initialCount && len(eventBuffer) == initialBufferSize {
+		if count == initialCount && len(eventBuffer) == initialBufferSize && len(expired) == initialExpired {
 			break
 		}
 	}
@@ -21,6 +21,11 @@ type PrivateRelayLimits struct {
 	ConnectionRateLimiterTokensPerInterval int
 	ConnectionRateLimiterInterval          int
 	ConnectionRateLimiterMaxTokens         int
+	MaxMessageLength                       int
+	MaxLimit                               int
+	AllowedKinds                           []KindRange
+	DeniedKinds                            []KindRange
+	Retention                              RetentionPolicy
 }
 
 type ChatRelayLimits struct {
@@ -32,6 +37,11 @@ type ChatRelayLimits struct {
 	ConnectionRateLimiterTokensPerInterval int
 	ConnectionRateLimiterInterval          int
 	ConnectionRateLimiterMaxTokens         int
+	MaxMessageLength                       int
+	MaxLimit                               int
+	AllowedKinds                           []KindRange
+	DeniedKinds                            []KindRange
+	Retention                              RetentionPolicy
 }
 
 type InboxRelayLimits struct {
@@ -43,6 +53,11 @@ type InboxRelayLimits struct {
 	ConnectionRateLimiterTokensPerInterval int
 	ConnectionRateLimiterInterval          int
 	ConnectionRateLimiterMaxTokens         int
+	MaxMessageLength                       int
+	MaxLimit                               int
+	AllowedKinds                           []KindRange
+	DeniedKinds                            []KindRange
+	Retention                              RetentionPolicy
 }
 
 type OutboxRelayLimits struct {
@@ -54,6 +69,11 @@ type OutboxRelayLimits struct {
 	ConnectionRateLimiterTokensPerInterval int
 	ConnectionRateLimiterInterval          int
 	ConnectionRateLimiterMaxTokens         int
+	MaxMessageLength                       int
+	MaxLimit                               int
+	AllowedKinds                           []KindRange
+	DeniedKinds                            []KindRange
+	Retention                              RetentionPolicy
 }
 
 func initRelayLimits() {
@@ -66,6 +86,11 @@ func initRelayLimits() {
 		ConnectionRateLimiterTokensPerInterval: getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
 		ConnectionRateLimiterInterval:          getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 5),
 		ConnectionRateLimiterMaxTokens:         getEnvInt("PRIVATE_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
+		MaxMessageLength:                       getEnvInt("PRIVATE_RELAY_MAX_MESSAGE_LENGTH", 512000),
+		MaxLimit:                               getEnvInt("PRIVATE_RELAY_MAX_LIMIT", 0),
+		AllowedKinds:                           getEnvKinds("PRIVATE_ALLOWED_KINDS", nil),
+		DeniedKinds:                            getEnvKinds("PRIVATE_DENIED_KINDS", nil),
+		Retention:                              getRetentionPolicy("PRIVATE"),
 	}
 
 	chatRelayLimits = ChatRelayLimits{
@@ -77,6 +102,11 @@ func initRelayLimits() {
 		ConnectionRateLimiterTokensPerInterval: getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
 		ConnectionRateLimiterInterval:          getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 3),
 		ConnectionRateLimiterMaxTokens:         getEnvInt("CHAT_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
+		MaxMessageLength:                       getEnvInt("CHAT_RELAY_MAX_MESSAGE_LENGTH", 512000),
+		MaxLimit:                               getEnvInt("CHAT_RELAY_MAX_LIMIT", 0),
+		AllowedKinds:                           getEnvKinds("CHAT_ALLOWED_KINDS", kindRanges(allowedChatKinds)),
+		DeniedKinds:                            getEnvKinds("CHAT_DENIED_KINDS", nil),
+		Retention:                              getRetentionPolicy("CHAT"),
 	}
 
 	inboxRelayLimits = InboxRelayLimits{
@@ -88,6 +118,11 @@ func initRelayLimits() {
 		ConnectionRateLimiterTokensPerInterval: getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
 		ConnectionRateLimiterInterval:          getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 1),
 		ConnectionRateLimiterMaxTokens:         getEnvInt("INBOX_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
+		MaxMessageLength:                       getEnvInt("INBOX_RELAY_MAX_MESSAGE_LENGTH", 512000),
+		MaxLimit:                               getEnvInt("INBOX_RELAY_MAX_LIMIT", 0),
+		AllowedKinds:                           getEnvKinds("INBOX_ALLOWED_KINDS", nil),
+		DeniedKinds:                            getEnvKinds("INBOX_DENIED_KINDS", nil),
+		Retention:                              getRetentionPolicy("INBOX"),
 	}
 
 	outboxRelayLimits = OutboxRelayLimits{
@@ -99,6 +134,11 @@ func initRelayLimits() {
 		ConnectionRateLimiterTokensPerInterval: getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_TOKENS_PER_INTERVAL", 3),
 		ConnectionRateLimiterInterval:          getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_INTERVAL", 1),
 		ConnectionRateLimiterMaxTokens:         getEnvInt("OUTBOX_RELAY_CONNECTION_RATE_LIMITER_MAX_TOKENS", 9),
+		MaxMessageLength:                       getEnvInt("OUTBOX_RELAY_MAX_MESSAGE_LENGTH", 512000),
+		MaxLimit:                               getEnvInt("OUTBOX_RELAY_MAX_LIMIT", 0),
+		AllowedKinds:                           getEnvKinds("OUTBOX_ALLOWED_KINDS", nil),
+		DeniedKinds:                            getEnvKinds("OUTBOX_DENIED_KINDS", nil),
+		Retention:                              getRetentionPolicy("OUTBOX"),
 	}
 
 	prettyPrintLimits("Private relay limits", privateRelayLimits)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +10,8 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
@@ -18,12 +21,16 @@ import (
 )
 
 var (
-	pool   *nostr.SimplePool
-	config = loadConfig()
+	pool *nostr.SimplePool
+	// config is loaded by main, tests set up the parts they need
+	config Config
 	fs     afero.Fs
 )
 
 func main() {
+	config = loadConfig()
+	newDBBackends()
+
 	nostr.InfoLogger = log.New(io.Discard, "", 0)
 	slog.SetLogLoggerLevel(getLogLevelFromConfig())
 	green := "\033[32m"
@@ -58,6 +65,12 @@ func main() {
 			ensureImportRelays()
 			runImport(mainCtx)
 			return
+		case "blastr":
+			runBlastrStatus()
+			return
+		case "blossom":
+			runBlossom(mainCtx)
+			return
 		case "help":
 			printHelp()
 			return
@@ -73,13 +86,16 @@ func main() {
 
 	log.Println("🚀 HAVEN", config.RelayVersion, "is booting up")
 	defer log.Println("🔌 HAVEN is shutting down")
-	log.Println("👥 Number of whitelisted pubkeys:", len(config.WhitelistedPubKeys))
-	log.Println("🚷 Number of blacklisted pubkeys:", len(config.BlacklistedPubKeys))
 
 	ensureImportRelays()
+	initDBs()
+	initManagement(mainCtx)
+	loadVanishRequests(mainCtx)
+	log.Println("👥 Number of whitelisted pubkeys:", config.WhitelistedPubKeys.Len())
+	log.Println("🚷 Number of blacklisted pubkeys:", config.BlacklistedPubKeys.Len())
 	wotModel := wot.NewSimpleInMemory(
 		pool,
-		config.WhitelistedPubKeys,
+		config.WhitelistedPubKeys.Load(),
 		config.ImportSeedRelays,
 		config.WotDepth,
 		config.WotMinimumFollowers,
@@ -87,22 +103,38 @@ func main() {
 	)
 	wot.Initialize(mainCtx, wotModel)
 	initRelays(mainCtx)
-
-	go func() {
-		go subscribeInboxAndChat(mainCtx)
-		go startPeriodicCloudBackups(mainCtx)
-		go wot.PeriodicRefresh(mainCtx, config.WotRefreshInterval)
-	}()
+	initBlastrQueue()
+
+	loops.Go(func() { subscribeInboxAndChat(mainCtx) })
+	loops.Go(func() { periodicInboxPull(mainCtx) })
+	loops.Go(func() { runBlastrQueue(mainCtx) })
+	loops.Go(func() { saveBlastrQueue(mainCtx) })
+	loops.Go(func() { startPeriodicCloudBackups(mainCtx) })
+	loops.Go(func() { wot.PeriodicRefresh(mainCtx, config.WotRefreshInterval) })
+	loops.Go(func() { watchAccessLists(mainCtx) })
+	loops.Go(func() { expireAccessEntries(mainCtx) })
+	loops.Go(func() { purgeExpiredEvents(mainCtx, config.ExpirationPurgeInterval) })
+	loops.Go(func() { runRetention(mainCtx, config.RetentionInterval) })
+	loops.Go(func() { collectBlossomGarbage(mainCtx, config.BlossomGCInterval) })
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("templates/static"))))
 	http.HandleFunc("/", dynamicRelayHandler)
 
 	addr := fmt.Sprintf("%s:%d", config.RelayBindAddress, config.RelayPort)
+	srv := &http.Server{Addr: addr}
 
-	log.Printf("🔗 listening at %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal("🚫 error starting server:", err)
-	}
+	go func() {
+		log.Printf("🔗 listening at %s", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("🚫 error starting server:", err)
+		}
+	}()
+
+	signalCtx, stop := signal.NotifyContext(mainCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-signalCtx.Done()
+
+	shutdown(srv, cancel)
 }
 
 func printHelp() {
@@ -114,6 +146,8 @@ func printHelp() {
 	fmt.Println("  backup  - backup the database")
 	fmt.Println("  restore - restore the database")
 	fmt.Println("  import  - import notes from seed relays")
+	fmt.Println("  blastr  - show the pending and failed blastr deliveries")
+	fmt.Println("  blossom - manage the Blossom media storage")
 	fmt.Println("  help    - show this help message")
 	fmt.Println()
 	fmt.Println("if no command is provided, the relay starts by default.")
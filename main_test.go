@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// setupTestBlobStorage replaces the file system with an in-memory one and stores the blobs in it.
+func setupTestBlobStorage(t *testing.T) {
+	t.Helper()
+	oldFs, oldStorage, oldPath := fs, blobStorage, config.BlossomPath
+	t.Cleanup(func() {
+		fs, blobStorage, config.BlossomPath = oldFs, oldStorage, oldPath
+	})
+
+	fs = afero.NewMemMapFs()
+	config.BlossomPath = "blossom"
+	blobStorage = localBlobStorage{path: config.BlossomPath}
+}
+
+// setupTestBlossom returns a Blossom server keeping its index in memory and its blobs in the
+// in-memory file system, and the secret key of the owner, who is the only whitelisted pubkey.
+func setupTestBlossom(t *testing.T) (*blossom.BlossomServer, string) {
+	t.Helper()
+	oldConfig := config
+	t.Cleanup(func() {
+		config = oldConfig
+	})
+	setupTestBlobStorage(t)
+
+	sk := nostr.GeneratePrivateKey()
+	config.OwnerPubKey, _ = nostr.GetPublicKey(sk)
+	config.WhitelistedPubKeys = NewPubKeySet(map[string]struct{}{config.OwnerPubKey: {}})
+	config.BlossomMirrorTimeoutSeconds = 10
+
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	bl := &blossom.BlossomServer{
+		ServiceURL: "http://localhost:3355",
+		Store:      blossom.EventStoreBlobIndexWrapper{Store: store, ServiceURL: "http://localhost:3355"},
+	}
+	bl.RejectUpload = append(bl.RejectUpload, RejectUploadNotWhitelisted, RejectUploadOverMaxSize)
+	return bl, sk
+}
+
+// blossomAuthorization returns the Authorization header allowing the action on the blobs.
+func blossomAuthorization(t *testing.T, sk string, action string, hashes ...string) string {
+	t.Helper()
+	auth := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"t", action},
+			{"expiration", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+		},
+	}
+	for _, hash := range hashes {
+		auth.Tags = append(auth.Tags, nostr.Tag{"x", hash})
+	}
+	if err := auth.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(data)
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
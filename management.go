@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+const managementStateName = "management"
+
+// managementState holds every change made through the NIP-86 management API. It is persisted
+// to disk and applied on top of the configuration at startup.
+type managementState struct {
+	BlockedIPs map[string]string           `json:"blocked_ips"`
+	Relays     map[string]*relayManagement `json:"relays"`
+
+	// Pubkeys allowed and banned by older versions, before they moved to the access store.
+	AllowedPubKeys map[string]string `json:"allowed_pubkeys,omitempty"`
+	BannedPubKeys  map[string]string `json:"banned_pubkeys,omitempty"`
+}
+
+// relayManagement holds the changes that only apply to one of the relays.
+type relayManagement struct {
+	Name            string            `json:"name,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Icon            string            `json:"icon,omitempty"`
+	AllowedKinds    []int             `json:"allowed_kinds,omitempty"`
+	DisallowedKinds []int             `json:"disallowed_kinds,omitempty"`
+	BannedEvents    map[string]string `json:"banned_events,omitempty"`
+}
+
+var management = struct {
+	sync.RWMutex
+	state managementState
+}{
+	state: newManagementState(),
+}
+
+func newManagementState() managementState {
+	return managementState{
+		BlockedIPs: make(map[string]string),
+		Relays:     make(map[string]*relayManagement),
+	}
+}
+
+// initManagement loads the changes made through the management API and the access lists. It must
+// run after the databases are initialized and before the WoT is.
+func initManagement(ctx context.Context) {
+	state := newManagementState()
+	if err := loadState(managementStateName, &state); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("🚫 error loading management state, ignoring it", "error", err)
+		state = newManagementState()
+	}
+
+	management.Lock()
+	management.state = fillManagementState(state)
+	management.Unlock()
+
+	migrateManagedPubKeys(ctx)
+	initAccessLists(ctx)
+}
+
+// migrateManagedPubKeys moves the pubkeys allowed and banned through the management API by older
+// versions into the access store.
+func migrateManagedPubKeys(ctx context.Context) {
+	management.RLock()
+	allowed, banned := management.state.AllowedPubKeys, management.state.BannedPubKeys
+	management.RUnlock()
+	if len(allowed) == 0 && len(banned) == 0 {
+		return
+	}
+
+	now := nostr.Now()
+	for _, l := range []struct {
+		list    string
+		reasons map[string]string
+	}{{accessAllow, allowed}, {accessDeny, banned}} {
+		for pubkey, reason := range l.reasons {
+			entry := AccessEntry{PubKey: pubkey, List: l.list, Reason: reason, Source: accessSourceAPI, AddedAt: now}
+			if err := accessStore.Put(ctx, entry); err != nil {
+				slog.Error("🚫 error migrating managed pubkeys to the access store", "error", err)
+				return
+			}
+		}
+	}
+
+	if err := updateManagement(func(s *managementState) {
+		s.AllowedPubKeys = nil
+		s.BannedPubKeys = nil
+	}); err != nil {
+		return
+	}
+	slog.Info("📦 managed pubkeys moved to the access store", "allowed", len(allowed), "banned", len(banned))
+}
+
+// fillManagementState initializes the maps missing from a state file.
+func fillManagementState(state managementState) managementState {
+	empty := newManagementState()
+	if state.BlockedIPs == nil {
+		state.BlockedIPs = empty.BlockedIPs
+	}
+	if state.Relays == nil {
+		state.Relays = empty.Relays
+	}
+	return state
+}
+
+// updateManagement applies fn to the management state and persists it.
+func updateManagement(fn func(s *managementState)) error {
+	management.Lock()
+	defer management.Unlock()
+	fn(&management.state)
+	if err := saveState(managementStateName, management.state); err != nil {
+		slog.Error("🚫 error saving management state", "error", err)
+		return fmt.Errorf("error saving changes: %w", err)
+	}
+	return nil
+}
+
+func (s *managementState) relay(name string) *relayManagement {
+	rm, ok := s.Relays[name]
+	if !ok {
+		rm = &relayManagement{}
+		s.Relays[name] = rm
+	}
+	if rm.BannedEvents == nil {
+		rm.BannedEvents = make(map[string]string)
+	}
+	return rm
+}
+
+func MustBeOwnerToManage(ctx context.Context, mp nip86.MethodParams) (bool, string) {
+	if khatru.GetAuthed(ctx) != config.OwnerPubKey {
+		slog.Debug("🚫 management call rejected: user is not the owner", "method", mp.MethodName(), "pubkey", khatru.GetAuthed(ctx))
+		return true, "restricted: only the relay owner can manage this relay"
+	}
+	return false, ""
+}
+
+func IPMustNotBeBlocked(r *http.Request) bool {
+	ip := khatru.GetIPFromRequest(r)
+	management.RLock()
+	defer management.RUnlock()
+	if _, ok := management.state.BlockedIPs[ip]; ok {
+		slog.Debug("🚫 connection rejected: ip is blocked", "ip", ip)
+		return true
+	}
+	return false
+}
+
+// setupManagementAPI exposes the NIP-86 management API on a relay, authorized with NIP-98 by the
+// relay owner, and applies the relay specific changes persisted from previous runs. Changes to the
+// access lists are propagated using ctx, as they outlive the API call.
+func setupManagementAPI(ctx context.Context, name string, relay *khatru.Relay, db DBBackend, kinds *KindPolicy) {
+	management.Lock()
+	if rm, ok := management.state.Relays[name]; ok {
+		if rm.Name != "" {
+			relay.Info.Name = rm.Name
+		}
+		if rm.Description != "" {
+			relay.Info.Description = rm.Description
+		}
+		if rm.Icon != "" {
+			relay.Info.Icon = rm.Icon
+		}
+		for _, kind := range rm.AllowedKinds {
+			kinds.Allow(kind)
+		}
+		for _, kind := range rm.DisallowedKinds {
+			kinds.Disallow(kind)
+		}
+	}
+	management.Unlock()
+
+	relay.RejectConnection = append(relay.RejectConnection, IPMustNotBeBlocked)
+	relay.RejectEvent = append(relay.RejectEvent, func(_ context.Context, event *nostr.Event) (bool, string) {
+		management.RLock()
+		defer management.RUnlock()
+		if rm, ok := management.state.Relays[name]; ok {
+			if _, banned := rm.BannedEvents[event.ID]; banned {
+				return true, "blocked: this event has been banned from this relay"
+			}
+		}
+		return false, ""
+	})
+
+	api := &relay.ManagementAPI
+	api.RejectAPICall = append(api.RejectAPICall, MustBeOwnerToManage)
+
+	api.BanPubKey = func(reqCtx context.Context, pubkey string, reason string) error {
+		if pubkey == config.OwnerPubKey {
+			return errors.New("the relay owner can't be banned")
+		}
+		entry, err := managedAccessEntry(pubkey, accessDeny, reason)
+		if err != nil {
+			return err
+		}
+		if err := accessStore.Put(reqCtx, entry); err != nil {
+			slog.Error("🚫 error saving access entry", "error", err)
+			return fmt.Errorf("error saving changes: %w", err)
+		}
+		slog.Info("🚷 pubkey banned through management API", "pubkey", pubkey, "reason", entry.Reason, "expires_at", entry.ExpiresAt)
+		applyAccessLists(ctx)
+		return nil
+	}
+	api.AllowPubKey = func(reqCtx context.Context, pubkey string, reason string) error {
+		entry, err := managedAccessEntry(pubkey, accessAllow, reason)
+		if err != nil {
+			return err
+		}
+		if err := accessStore.Put(reqCtx, entry); err != nil {
+			slog.Error("🚫 error saving access entry", "error", err)
+			return fmt.Errorf("error saving changes: %w", err)
+		}
+		slog.Info("👥 pubkey allowed through management API", "pubkey", pubkey, "reason", entry.Reason, "expires_at", entry.ExpiresAt)
+		applyAccessLists(ctx)
+		return nil
+	}
+	api.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return listAccessEntries(ctx, accessDeny)
+	}
+	api.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return listAccessEntries(ctx, accessAllow)
+	}
+
+	api.BanEvent = func(ctx context.Context, id string, reason string) error {
+		if err := updateManagement(func(s *managementState) {
+			s.relay(name).BannedEvents[id] = reason
+		}); err != nil {
+			return err
+		}
+		events, err := eventstore.RelayWrapper{Store: db}.QuerySync(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			return fmt.Errorf("error querying event: %w", err)
+		}
+		for _, event := range events {
+			if err := db.DeleteEvent(ctx, event); err != nil {
+				return fmt.Errorf("error deleting event: %w", err)
+			}
+		}
+		slog.Info("🚫 event banned through management API", "relay", name, "id", id, "reason", reason)
+		return nil
+	}
+	api.AllowEvent = func(ctx context.Context, id string, reason string) error {
+		return updateManagement(func(s *managementState) {
+			delete(s.relay(name).BannedEvents, id)
+		})
+	}
+	api.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		management.RLock()
+		defer management.RUnlock()
+		var result []nip86.IDReason
+		if rm, ok := management.state.Relays[name]; ok {
+			for _, id := range slices.Sorted(maps.Keys(rm.BannedEvents)) {
+				result = append(result, nip86.IDReason{ID: id, Reason: rm.BannedEvents[id]})
+			}
+		}
+		return result, nil
+	}
+
+	api.ChangeRelayName = func(ctx context.Context, value string) error {
+		if err := updateManagement(func(s *managementState) { s.relay(name).Name = value }); err != nil {
+			return err
+		}
+		relay.Info.Name = value
+		return nil
+	}
+	api.ChangeRelayDescription = func(ctx context.Context, value string) error {
+		if err := updateManagement(func(s *managementState) { s.relay(name).Description = value }); err != nil {
+			return err
+		}
+		relay.Info.Description = value
+		return nil
+	}
+	api.ChangeRelayIcon = func(ctx context.Context, value string) error {
+		if err := updateManagement(func(s *managementState) { s.relay(name).Icon = value }); err != nil {
+			return err
+		}
+		relay.Info.Icon = value
+		return nil
+	}
+
+	api.AllowKind = func(ctx context.Context, kind int) error {
+		if err := updateManagement(func(s *managementState) {
+			rm := s.relay(name)
+			rm.DisallowedKinds = slices.DeleteFunc(rm.DisallowedKinds, func(k int) bool { return k == kind })
+			if kinds.NeedsAllowEntry(kind) {
+				rm.AllowedKinds = appendUniqueKind(rm.AllowedKinds, kind)
+			}
+		}); err != nil {
+			return err
+		}
+		kinds.Allow(kind)
+		return nil
+	}
+	api.DisallowKind = func(ctx context.Context, kind int) error {
+		if err := updateManagement(func(s *managementState) {
+			rm := s.relay(name)
+			rm.AllowedKinds = slices.DeleteFunc(rm.AllowedKinds, func(k int) bool { return k == kind })
+			rm.DisallowedKinds = appendUniqueKind(rm.DisallowedKinds, kind)
+		}); err != nil {
+			return err
+		}
+		kinds.Disallow(kind)
+		return nil
+	}
+	api.ListAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return kinds.Allowed(), nil
+	}
+	api.ListDisAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return kinds.Denied(), nil
+	}
+
+	api.BlockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		return updateManagement(func(s *managementState) {
+			s.BlockedIPs[ip.String()] = reason
+		})
+	}
+	api.UnblockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		return updateManagement(func(s *managementState) {
+			delete(s.BlockedIPs, ip.String())
+		})
+	}
+	api.ListBlockedIPs = func(ctx context.Context) ([]nip86.IPReason, error) {
+		management.RLock()
+		defer management.RUnlock()
+		var result []nip86.IPReason
+		for _, ip := range slices.Sorted(maps.Keys(management.state.BlockedIPs)) {
+			result = append(result, nip86.IPReason{IP: ip, Reason: management.state.BlockedIPs[ip]})
+		}
+		return result, nil
+	}
+}
+
+// managedAccessEntry builds the access entry for a pubkey allowed or banned through the management
+// API. A reason starting with a duration in brackets, such as "[24h] spam" or "[7d] spam", makes
+// the entry expire after that long.
+func managedAccessEntry(pubkey string, list string, reason string) (AccessEntry, error) {
+	now := nostr.Now()
+	entry := AccessEntry{
+		PubKey:  pubkey,
+		List:    list,
+		Reason:  reason,
+		Source:  accessSourceAPI,
+		AddedAt: now,
+	}
+
+	rest, found := strings.CutPrefix(reason, "[")
+	if !found {
+		return entry, nil
+	}
+	duration, rest, found := strings.Cut(rest, "]")
+	if !found {
+		return entry, nil
+	}
+	d, err := parseDurationWithDays(duration)
+	if err != nil {
+		return AccessEntry{}, fmt.Errorf("invalid duration %q: %w", duration, err)
+	}
+	entry.Reason = strings.TrimSpace(rest)
+	entry.ExpiresAt = now + nostr.Timestamp(d.Seconds())
+	return entry, nil
+}
+
+// listAccessEntries lists the unexpired pubkeys of an access list in sorted order, with their
+// reasons and expiration dates.
+func listAccessEntries(ctx context.Context, list string) ([]nip86.PubKeyReason, error) {
+	entries, err := accessStore.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing access entries: %w", err)
+	}
+
+	now := nostr.Now()
+	result := make([]nip86.PubKeyReason, 0, len(entries))
+	for _, entry := range entries {
+		if entry.List != list || entry.Expired(now) {
+			continue
+		}
+		reason := entry.Reason
+		if entry.ExpiresAt != 0 {
+			reason = strings.TrimSpace(fmt.Sprintf("%s (expires %s)", reason, entry.ExpiresAt.Time().UTC().Format(time.RFC3339)))
+		}
+		result = append(result, nip86.PubKeyReason{PubKey: entry.PubKey, Reason: reason})
+	}
+	if list == accessAllow && !slices.ContainsFunc(result, func(r nip86.PubKeyReason) bool { return r.PubKey == config.OwnerPubKey }) {
+		result = append(result, nip86.PubKeyReason{PubKey: config.OwnerPubKey, Reason: "relay owner"})
+	}
+	slices.SortFunc(result, func(a, b nip86.PubKeyReason) int { return strings.Compare(a.PubKey, b.PubKey) })
+	return result, nil
+}
+
+func appendUniqueKind(kinds []int, kind int) []int {
+	if slices.Contains(kinds, kind) {
+		return kinds
+	}
+	return append(kinds, kind)
+}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"maps"
 	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +19,13 @@ const DefaultWotLevel = 3
 
 type SimpleInMemory struct {
 	pubkeys atomic.Pointer[map[string]bool]
+	mu      sync.RWMutex // guards WhitelistedPubKeys
+
+	// refreshMu guards refreshing, set while a background refresh runs, and refreshPending, set
+	// when the whitelist changed again since it started
+	refreshMu      sync.Mutex
+	refreshing     bool
+	refreshPending bool
 
 	// Dependencies for Refresh
 	Pool               *nostr.SimplePool
@@ -70,11 +78,65 @@ func (wt *SimpleInMemory) Init(ctx context.Context) {
 	wt.Refresh(ctx)
 }
 
+// UpdateWhitelist replaces the whitelisted pubkeys the WoT is built from. They are trusted
+// immediately, while the rest of the network is rebuilt in the background.
+func (wt *SimpleInMemory) UpdateWhitelist(ctx context.Context, whitelistedPubKeys map[string]struct{}) {
+	wt.mu.Lock()
+	wt.WhitelistedPubKeys = whitelistedPubKeys
+	wt.mu.Unlock()
+
+	if wt.WotDepth == 0 {
+		return
+	}
+
+	if m := wt.pubkeys.Load(); m != nil {
+		newWot := maps.Clone(*m)
+		for pubkey := range whitelistedPubKeys {
+			newWot[pubkey] = true
+		}
+		wt.pubkeys.Store(&newWot)
+	}
+
+	wt.refreshInBackground(ctx)
+}
+
+// refreshInBackground rebuilds the WoT in a new goroutine, unless a background refresh is already
+// running. In that case, it runs once more when done, so a burst of whitelist changes only takes
+// one extra refresh, built from the latest whitelist.
+func (wt *SimpleInMemory) refreshInBackground(ctx context.Context) {
+	wt.refreshMu.Lock()
+	defer wt.refreshMu.Unlock()
+	if wt.refreshing {
+		wt.refreshPending = true
+		return
+	}
+	wt.refreshing = true
+
+	go func() {
+		for {
+			wt.Refresh(ctx)
+
+			wt.refreshMu.Lock()
+			if !wt.refreshPending || ctx.Err() != nil {
+				wt.refreshing, wt.refreshPending = false, false
+				wt.refreshMu.Unlock()
+				return
+			}
+			wt.refreshPending = false
+			wt.refreshMu.Unlock()
+		}
+	}()
+}
+
 func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 	if wt.WotDepth == 0 {
 		return
 	}
 
+	wt.mu.RLock()
+	whitelistedPubKeys := wt.WhitelistedPubKeys
+	wt.mu.RUnlock()
+
 	var eventsAnalysed atomic.Int64
 	pubkeyFollowers := xsync.NewMap[string, *atomic.Int64]()
 	relaysDiscovered := xsync.NewMap[string, bool]()
@@ -82,7 +144,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 	newWot := make(map[string]bool)
 
 	if wt.WotDepth >= 1 {
-		for pubkey := range wt.WhitelistedPubKeys {
+		for pubkey := range whitelistedPubKeys {
 			newWot[pubkey] = true
 		}
 	}
@@ -97,7 +159,7 @@ func (wt *SimpleInMemory) Refresh(ctx context.Context) {
 	defer cancel()
 
 	filter := nostr.Filter{
-		Authors: slices.Collect(maps.Keys(wt.WhitelistedPubKeys)),
+		Authors: slices.Collect(maps.Keys(whitelistedPubKeys)),
 		Kinds:   []int{nostr.KindFollowList},
 	}
 
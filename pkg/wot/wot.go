@@ -20,6 +20,10 @@ type Initializer interface {
 	Init(ctx context.Context)
 }
 
+type WhitelistUpdater interface {
+	UpdateWhitelist(ctx context.Context, whitelistedPubKeys map[string]struct{})
+}
+
 var wotInstance atomic.Value
 
 func GetInstance() Model {
@@ -57,3 +61,11 @@ func PeriodicRefresh(ctx context.Context, interval time.Duration) {
 		}
 	}
 }
+
+func UpdateWhitelist(ctx context.Context, whitelistedPubKeys map[string]struct{}) {
+	instance := GetInstance()
+	if updater, ok := instance.(WhitelistUpdater); ok {
+		slog.Info("🌐 Updating WoT whitelist", "pubkeys", len(whitelistedPubKeys))
+		updater.UpdateWhitelist(ctx, whitelistedPubKeys)
+	}
+}
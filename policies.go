@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/barrydeen/haven/pkg/wot"
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip70"
 )
 
 func MustBeWhitelistedToQuery(ctx context.Context, _ nostr.Filter) (bool, string) {
 	authenticatedUser := khatru.GetAuthed(ctx)
-	if _, ok := config.WhitelistedPubKeys[authenticatedUser]; !ok {
+	if !config.WhitelistedPubKeys.Has(authenticatedUser) {
 		slog.Debug("🚫 query rejected: user is not whitelisted", "user", authenticatedUser)
 		return true, "restricted: you must be whitelisted to query this relay"
 	}
@@ -27,16 +35,42 @@ func MustBeInWotToQuery(ctx context.Context, _ nostr.Filter) (bool, string) {
 	return false, ""
 }
 
+// MustBePublishedByAuthorIfProtected only accepts NIP-70 protected events from their authenticated
+// author, and rejects reposts of protected events.
+func MustBePublishedByAuthorIfProtected(ctx context.Context, event *nostr.Event) (bool, string) {
+	if nip70.HasEmbeddedProtected(*event) {
+		return true, "blocked: can't repost nip70 protected"
+	}
+	if !nip70.IsProtected(*event) {
+		return false, ""
+	}
+	authenticatedUser := khatru.GetAuthed(ctx)
+	if authenticatedUser == "" {
+		return true, "auth-required: must be published by authenticated event author"
+	}
+	if authenticatedUser != event.PubKey {
+		slog.Debug("🚫 event rejected: protected event not published by its author", "event", event.ID, "pubkey", authenticatedUser)
+		return true, "blocked: must be published by event author"
+	}
+	return false, ""
+}
+
+// isProtected reports whether the event, or the event it reposts, is NIP-70 protected and must not
+// be published anywhere else than where its author put it.
+func isProtected(event *nostr.Event) bool {
+	return nip70.IsProtected(*event) || nip70.HasEmbeddedProtected(*event)
+}
+
 func MustBeWhitelistedToPost(ctx context.Context, event *nostr.Event) (bool, string) {
 	// Event from a whitelisted pubkey can always be posted, even if the user is not authenticated
-	if _, ok := config.WhitelistedPubKeys[event.PubKey]; ok {
+	if config.WhitelistedPubKeys.Has(event.PubKey) {
 		return false, ""
 	}
 	authenticatedUser := khatru.GetAuthed(ctx)
 	if authenticatedUser == "" {
 		return true, "auth-required: you must be authenticated to post to this relay"
 	}
-	if _, ok := config.WhitelistedPubKeys[authenticatedUser]; !ok {
+	if !config.WhitelistedPubKeys.Has(authenticatedUser) {
 		slog.Debug("🚫 event rejected: user is not whitelisted", "event", event.ID, "pubkey", authenticatedUser)
 		return true, "restricted: you must be whitelisted to post to this relay"
 	}
@@ -61,7 +95,7 @@ func MustBeInWotToPost(ctx context.Context, event *nostr.Event) (bool, string) {
 
 func MustNotBeBlacklistedToPost(ctx context.Context, event *nostr.Event) (bool, string) {
 	// Events from a blacklisted pubkey ARE always rejected
-	if _, ok := config.BlacklistedPubKeys[event.PubKey]; ok {
+	if config.BlacklistedPubKeys.Has(event.PubKey) {
 		slog.Debug("🚫 event rejected: event author is blacklisted", "event", event.ID, "pubkey", event.PubKey)
 		return true, "you are blacklisted from this relay"
 	}
@@ -70,7 +104,7 @@ func MustNotBeBlacklistedToPost(ctx context.Context, event *nostr.Event) (bool,
 	if authenticatedUser == "" {
 		return true, "auth-required: you must be authenticated to post to this relay"
 	}
-	if _, ok := config.BlacklistedPubKeys[authenticatedUser]; ok {
+	if config.BlacklistedPubKeys.Has(authenticatedUser) {
 		slog.Debug("🚫 event rejected: authenticated user is blacklisted", "event", event.ID, "pubkey", authenticatedUser)
 		return true, "you are blacklisted from this relay"
 	}
@@ -88,6 +122,10 @@ var allowedChatKinds = map[int]struct{}{
 
 	nostr.KindGiftWrap: {},
 
+	// Deletion (NIP-09) and request to vanish (NIP-62), both advertised by the relay
+	nostr.KindDeletion:  {},
+	kindRequestToVanish: {},
+
 	nostr.KindSimpleGroupPutUser:      {},
 	nostr.KindSimpleGroupRemoveUser:   {},
 	nostr.KindSimpleGroupEditMetadata: {},
@@ -105,12 +143,220 @@ var allowedChatKinds = map[int]struct{}{
 	nostr.KindSimpleGroupRoles:    {},
 }
 
-func EventMustBeChatRelated(_ context.Context, event *nostr.Event) (bool, string) {
-	if _, ok := allowedChatKinds[event.Kind]; ok {
-		return false, ""
+// maxKind is the highest event kind defined by NIP-01.
+const maxKind = 65535
+
+// KindRange is an inclusive range of event kinds.
+type KindRange struct {
+	Min int
+	Max int
+}
+
+func (r KindRange) Contains(kind int) bool {
+	return kind >= r.Min && kind <= r.Max
+}
+
+func (r KindRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func (r KindRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON accepts either a single kind number or a string such as "30000-39999".
+func (r *KindRange) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	ranges, err := parseKindRanges(s)
+	if err != nil {
+		return err
+	}
+	if len(ranges) != 1 {
+		return fmt.Errorf("invalid kind %s", data)
+	}
+	*r = ranges[0]
+	return nil
+}
+
+// parseKindRanges parses a comma separated list of kinds and kind ranges, such as "1,7,30000-39999".
+func parseKindRanges(s string) ([]KindRange, error) {
+	var ranges []KindRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid kind %q", part)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid kind %q", part)
+		}
+		if from < 0 || to > maxKind || from > to {
+			return nil, fmt.Errorf("invalid kind range %q", part)
+		}
+		ranges = append(ranges, KindRange{Min: from, Max: to})
+	}
+	return ranges, nil
+}
+
+// kindRanges turns a set of kinds into single kind ranges.
+func kindRanges(kinds map[int]struct{}) []KindRange {
+	ranges := make([]KindRange, 0, len(kinds))
+	for _, kind := range slices.Sorted(maps.Keys(kinds)) {
+		ranges = append(ranges, KindRange{Min: kind, Max: kind})
+	}
+	return ranges
+}
+
+// KindPolicy restricts the event kinds a relay accepts. Denied kinds are always rejected and, when
+// the configuration has an allowlist, only the kinds in it are accepted. The ranges come from the
+// configuration, while single kinds can also be changed at runtime through the management API and
+// take precedence over the ranges.
+type KindPolicy struct {
+	mu            sync.RWMutex
+	allowed       map[int]struct{}
+	denied        map[int]struct{}
+	allowedRanges []KindRange
+	deniedRanges  []KindRange
+	// hasAllowlist is set when the configuration has an allowlist. Otherwise, allowed kinds only
+	// override the denied ranges.
+	hasAllowlist bool
+}
+
+func NewKindPolicy(allowed []KindRange, denied []KindRange) *KindPolicy {
+	p := &KindPolicy{
+		allowed: make(map[int]struct{}),
+		denied:  make(map[int]struct{}),
+	}
+	for _, r := range allowed {
+		if r.Min == r.Max {
+			p.allowed[r.Min] = struct{}{}
+		} else {
+			p.allowedRanges = append(p.allowedRanges, r)
+		}
+	}
+	for _, r := range denied {
+		if r.Min == r.Max {
+			p.denied[r.Min] = struct{}{}
+		} else {
+			p.deniedRanges = append(p.deniedRanges, r)
+		}
+	}
+	p.hasAllowlist = len(allowed) > 0
+	return p
+}
+
+func (p *KindPolicy) RejectEvent(_ context.Context, event *nostr.Event) (bool, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.accepts(event.Kind) {
+		return true, fmt.Sprintf("blocked: events of kind %d are not allowed in this relay", event.Kind)
+	}
+	return false, ""
+}
+
+func (p *KindPolicy) accepts(kind int) bool {
+	if _, ok := p.denied[kind]; ok {
+		return false
+	}
+	if _, ok := p.allowed[kind]; ok {
+		return true
+	}
+	if p.inDeniedRange(kind) {
+		return false
+	}
+	if !p.hasAllowlist {
+		return true
+	}
+	return slices.ContainsFunc(p.allowedRanges, func(r KindRange) bool { return r.Contains(kind) })
+}
+
+func (p *KindPolicy) inDeniedRange(kind int) bool {
+	return slices.ContainsFunc(p.deniedRanges, func(r KindRange) bool { return r.Contains(kind) })
+}
+
+// Allow removes the kind from the denylist. It is also added to the allowlist if the relay has one,
+// or if the kind is in a denied range, as reported by NeedsAllowEntry.
+func (p *KindPolicy) Allow(kind int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.denied, kind)
+	if p.hasAllowlist || p.inDeniedRange(kind) {
+		p.allowed[kind] = struct{}{}
+	}
+}
+
+// NeedsAllowEntry reports whether allowing the kind adds it to the allowlist, which has to be kept
+// for the kind to stay allowed. Otherwise, allowing it only removes it from the denylist.
+func (p *KindPolicy) NeedsAllowEntry(kind int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hasAllowlist || p.inDeniedRange(kind)
+}
+
+// Disallow adds the kind to the denylist and removes it from the allowlist.
+func (p *KindPolicy) Disallow(kind int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.denied[kind] = struct{}{}
+	delete(p.allowed, kind)
+}
+
+// Allowed lists the kinds in the allowlist, with its ranges expanded, leaving out the denied ones.
+func (p *KindPolicy) Allowed() []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.list(p.allowed, p.allowedRanges, true)
+}
+
+// Denied lists the kinds in the denylist, with its ranges expanded, leaving out the allowed ones.
+func (p *KindPolicy) Denied() []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.list(p.denied, p.deniedRanges, false)
+}
+
+// list expands the kinds and ranges, keeping those the relay accepts or rejects as expected.
+func (p *KindPolicy) list(kinds map[int]struct{}, ranges []KindRange, accepted bool) []int {
+	set := make(map[int]struct{})
+	for kind := range kinds {
+		if p.accepts(kind) == accepted {
+			set[kind] = struct{}{}
+		}
+	}
+	for _, r := range ranges {
+		for kind := r.Min; kind <= r.Max; kind++ {
+			if p.accepts(kind) == accepted {
+				set[kind] = struct{}{}
+			}
+		}
 	}
+	return slices.Sorted(maps.Keys(set))
+}
 
-	return true, "only chat related events are allowed"
+// MaxFilterLimit caps the number of events returned for a filter.
+func MaxFilterLimit(max int) func(context.Context, *nostr.Filter) {
+	return func(_ context.Context, filter *nostr.Filter) {
+		if filter.LimitZero {
+			return
+		}
+		if filter.Limit == 0 || filter.Limit > max {
+			filter.Limit = max
+		}
+	}
 }
 
 func OnlyGiftWrappedDMs(_ context.Context, event *nostr.Event) (bool, string) {
@@ -127,7 +373,7 @@ func MustTagWhitelistedPubKey(_ context.Context, event *nostr.Event) (bool, stri
 		if len(tag) < 2 {
 			continue
 		}
-		if _, ok := config.WhitelistedPubKeys[tag[1]]; ok {
+		if config.WhitelistedPubKeys.Has(tag[1]) {
 			return false, ""
 		}
 	}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseKindRanges(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []KindRange
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "1", want: []KindRange{{1, 1}}},
+		{in: "1,7,30000-39999", want: []KindRange{{1, 1}, {7, 7}, {30000, 39999}}},
+		{in: " 5 - 10 , ,0", want: []KindRange{{5, 10}, {0, 0}}},
+		{in: "0-65535", want: []KindRange{{0, maxKind}}},
+		{in: "1-1", want: []KindRange{{1, 1}}},
+		// Overlapping ranges are kept as they are
+		{in: "1-10,5-20", want: []KindRange{{1, 10}, {5, 20}}},
+		{in: "a", wantErr: true},
+		{in: "1,b", wantErr: true},
+		{in: "10-5", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "65536", wantErr: true},
+		{in: "1-65536", wantErr: true},
+		{in: "1-2-3", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseKindRanges(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseKindRanges(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("parseKindRanges(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestKindRangeJSON(t *testing.T) {
+	var ranges []KindRange
+	if err := json.Unmarshal([]byte(`[7, "30000-39999", "1"]`), &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if want := []KindRange{{7, 7}, {30000, 39999}, {1, 1}}; !slices.Equal(ranges, want) {
+		t.Errorf("unmarshalled %v, want %v", ranges, want)
+	}
+
+	data, err := json.Marshal(ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `["7","30000-39999","1"]`; got != want {
+		t.Errorf("marshalled %s, want %s", got, want)
+	}
+
+	var r KindRange
+	if err := json.Unmarshal([]byte(`"1,2"`), &r); err == nil {
+		t.Error("unmarshalling a list into a single range succeeded")
+	}
+}
+
+func TestKindPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		denied    string
+		allow     []int // allowed through the management API, before disallow
+		disallow  []int
+		accepted  []int
+		rejected  []int
+		listAllow []int
+		listDeny  []int
+	}{
+		{
+			name:     "no lists accepts everything",
+			accepted: []int{0, 1, 4, 30023, maxKind},
+		},
+		{
+			name:     "denylist",
+			denied:   "4,1059,20000-20002",
+			accepted: []int{1, 19999, 20003},
+			rejected: []int{4, 1059, 20000, 20001, 20002},
+			listDeny: []int{4, 1059, 20000, 20001, 20002},
+		},
+		{
+			name:      "allowlist",
+			allowed:   "1,7,30000-30002",
+			accepted:  []int{1, 7, 30000, 30002},
+			rejected:  []int{0, 4, 29999, 30003},
+			listAllow: []int{1, 7, 30000, 30001, 30002},
+		},
+		{
+			name:      "denied kinds win over allowed ranges",
+			allowed:   "1-10",
+			denied:    "4,6-7",
+			accepted:  []int{1, 3, 5, 8, 10},
+			rejected:  []int{4, 6, 7, 11},
+			listAllow: []int{1, 2, 3, 5, 8, 9, 10},
+			listDeny:  []int{4, 6, 7},
+		},
+		{
+			name:      "allowing a kind lifts its denial",
+			denied:    "4,20000-20002",
+			allow:     []int{4, 20001},
+			accepted:  []int{4, 20001, 1},
+			rejected:  []int{20000, 20002},
+			listAllow: []int{20001},
+			listDeny:  []int{20000, 20002},
+		},
+		{
+			name:      "allowing a kind extends the allowlist",
+			allowed:   "1",
+			allow:     []int{7},
+			accepted:  []int{1, 7},
+			rejected:  []int{0, 6, 8},
+			listAllow: []int{1, 7},
+		},
+		{
+			name:      "disallowing a kind wins over every range",
+			allowed:   "1-10",
+			disallow:  []int{5},
+			accepted:  []int{4, 6},
+			rejected:  []int{5},
+			listAllow: []int{1, 2, 3, 4, 6, 7, 8, 9, 10},
+			listDeny:  []int{5},
+		},
+		{
+			name:     "disallowing an allowed kind",
+			allow:    []int{7},
+			disallow: []int{7},
+			accepted: []int{6},
+			rejected: []int{7},
+			listDeny: []int{7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := parseKindRanges(tt.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied, err := parseKindRanges(tt.denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewKindPolicy(allowed, denied)
+			for _, kind := range tt.allow {
+				p.Allow(kind)
+			}
+			for _, kind := range tt.disallow {
+				p.Disallow(kind)
+			}
+
+			for _, kind := range tt.accepted {
+				if reject, msg := p.RejectEvent(context.Background(), &nostr.Event{Kind: kind}); reject {
+					t.Errorf("kind %d rejected: %s", kind, msg)
+				}
+			}
+			for _, kind := range tt.rejected {
+				if reject, _ := p.RejectEvent(context.Background(), &nostr.Event{Kind: kind}); !reject {
+					t.Errorf("kind %d accepted", kind)
+				}
+			}
+			if got := p.Allowed(); !slices.Equal(got, tt.listAllow) {
+				t.Errorf("Allowed() = %v, want %v", got, tt.listAllow)
+			}
+			if got := p.Denied(); !slices.Equal(got, tt.listDeny) {
+				t.Errorf("Denied() = %v, want %v", got, tt.listDeny)
+			}
+		})
+	}
+}
+
+func TestNeedsAllowEntry(t *testing.T) {
+	withoutAllowlist := NewKindPolicy(nil, []KindRange{{4, 4}, {20000, 29999}})
+	withAllowlist := NewKindPolicy([]KindRange{{1, 1}}, nil)
+	tests := []struct {
+		policy *KindPolicy
+		kind   int
+		want   bool
+	}{
+		// Only removed from the denylist
+		{withoutAllowlist, 4, false},
+		{withoutAllowlist, 1, false},
+		// Allowed over a denied range
+		{withoutAllowlist, 20001, true},
+		{withAllowlist, 7, true},
+		{withAllowlist, 1, true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.NeedsAllowEntry(tt.kind); got != tt.want {
+			t.Errorf("NeedsAllowEntry(%d) = %v, want %v", tt.kind, got, tt.want)
+		}
+	}
+}
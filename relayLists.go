@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayList holds the relays advertised in a NIP-65 relay list (kind 10002).
+type relayList struct {
+	Read  []string
+	Write []string
+}
+
+// parseRelayList extracts the read and write relays from a kind 10002 event. Relays without a
+// marker are used for both.
+func parseRelayList(ev *nostr.Event) relayList {
+	var rl relayList
+	for tag := range ev.Tags.FindAll("r") {
+		if len(tag) < 2 || !nostr.IsValidRelayURL(tag[1]) {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		marker := ""
+		if len(tag) > 2 {
+			marker = tag[2]
+		}
+		if marker == "" || marker == "read" {
+			rl.Read = appendUnique(rl.Read, url)
+		}
+		if marker == "" || marker == "write" {
+			rl.Write = appendUnique(rl.Write, url)
+		}
+	}
+	return rl
+}
+
+// fetchRelayLists returns the latest relay list of each pubkey found on the given relays.
+func fetchRelayLists(ctx context.Context, relays []string, pubkeys []string, timeout time.Duration) map[string]relayList {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	filter := nostr.Filter{
+		Authors: pubkeys,
+		Kinds:   []int{nostr.KindRelayListMetadata},
+	}
+
+	latest := make(map[string]*nostr.Event, len(pubkeys))
+	for ev := range pool.FetchMany(ctx, relays, filter) {
+		if old, ok := latest[ev.PubKey]; !ok || ev.CreatedAt > old.CreatedAt {
+			latest[ev.PubKey] = ev.Event
+		}
+	}
+	if ctx.Err() != nil {
+		slog.Warn("⚠️ timeout while fetching relay lists, using what was found", "found", len(latest), "pubkeys", len(pubkeys))
+	}
+
+	lists := make(map[string]relayList, len(latest))
+	for pubkey, ev := range latest {
+		lists[pubkey] = parseRelayList(ev)
+	}
+	return lists
+}
+
+const relayListCacheTTL = 6 * time.Hour
+
+// relayListCache remembers the relay lists fetched from the seed relays, including the pubkeys
+// that don't have one, so they are not fetched again for every event.
+type relayListCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRelayList
+}
+
+type cachedRelayList struct {
+	list      relayList
+	fetchedAt time.Time
+}
+
+var relayListsCache = &relayListCache{entries: make(map[string]cachedRelayList)}
+
+// get returns the relay lists of the pubkeys, fetching the missing and stale ones from the seed relays.
+func (c *relayListCache) get(ctx context.Context, pubkeys []string, timeout time.Duration) map[string]relayList {
+	lists := make(map[string]relayList, len(pubkeys))
+	var missing []string
+
+	c.mu.Lock()
+	for _, pubkey := range pubkeys {
+		if cached, ok := c.entries[pubkey]; ok && time.Since(cached.fetchedAt) < relayListCacheTTL {
+			lists[pubkey] = cached.list
+		} else {
+			missing = append(missing, pubkey)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		return lists
+	}
+
+	fetched := fetchRelayLists(ctx, config.ImportSeedRelays, missing, timeout)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pubkey := range missing {
+		c.entries[pubkey] = cachedRelayList{list: fetched[pubkey], fetchedAt: now}
+		lists[pubkey] = fetched[pubkey]
+	}
+	for pubkey, cached := range c.entries {
+		if now.Sub(cached.fetchedAt) >= relayListCacheTTL {
+			delete(c.entries, pubkey)
+		}
+	}
+	return lists
+}
+
+func appendUnique(s []string, v string) []string {
+	if slices.Contains(s, v) {
+		return s
+	}
+	return append(s, v)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// KindMaxAge is the longest a relay keeps the events of some kinds.
+type KindMaxAge struct {
+	Kinds  *KindRange // nil for every kind not matched by another entry
+	MaxAge time.Duration
+}
+
+func (a KindMaxAge) String() string {
+	kinds := "*"
+	if a.Kinds != nil {
+		kinds = a.Kinds.String()
+	}
+	return kinds + "=" + a.MaxAge.String()
+}
+
+func (a KindMaxAge) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// parseKindMaxAges parses a comma separated list of maximum ages per kind, such as
+// "7=30d,1-3=90d,*=365d".
+func parseKindMaxAges(s string) ([]KindMaxAge, error) {
+	var ages []KindMaxAge
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kinds, age, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid maximum age %q, expected kinds=duration", part)
+		}
+		maxAge, err := parseDurationWithDays(strings.TrimSpace(age))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maximum age %q: %w", part, err)
+		}
+		entry := KindMaxAge{MaxAge: maxAge}
+		if kinds = strings.TrimSpace(kinds); kinds != "*" {
+			ranges, err := parseKindRanges(kinds)
+			if err != nil {
+				return nil, err
+			}
+			if len(ranges) != 1 {
+				return nil, fmt.Errorf("invalid maximum age %q", part)
+			}
+			entry.Kinds = &ranges[0]
+		}
+		ages = append(ages, entry)
+	}
+	return ages, nil
+}
+
+// RetentionPolicy limits what a relay keeps. Zero values disable the matching limit.
+type RetentionPolicy struct {
+	MaxAge             []KindMaxAge
+	MaxEventsPerAuthor int
+	MaxSizeMB          int
+}
+
+func getRetentionPolicy(prefix string) RetentionPolicy {
+	return RetentionPolicy{
+		MaxAge:             getEnvKindMaxAges(prefix+"_RETENTION_MAX_AGE", nil),
+		MaxEventsPerAuthor: getEnvInt(prefix+"_RETENTION_MAX_EVENTS_PER_AUTHOR", 0),
+		MaxSizeMB:          getEnvInt(prefix+"_RETENTION_MAX_SIZE_MB", 0),
+	}
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return len(p.MaxAge) > 0 || p.MaxEventsPerAuthor > 0 || p.MaxSizeMB > 0
+}
+
+// maxAge returns the maximum age of the kind, or 0 if it is kept forever. Entries for specific kinds
+// take precedence over the "*" entry.
+func (p RetentionPolicy) maxAge(kind int) time.Duration {
+	var fallback time.Duration
+	for _, a := range p.MaxAge {
+		if a.Kinds == nil {
+			fallback = a.MaxAge
+		} else if a.Kinds.Contains(kind) {
+			return a.MaxAge
+		}
+	}
+	return fallback
+}
+
+// Documents describes the maximum ages in NIP-11. The maximum number of events per author and the
+// size cap can't be expressed there.
+func (p RetentionPolicy) Documents() []*nip11.RelayRetentionDocument {
+	var docs []*nip11.RelayRetentionDocument
+	for _, a := range p.MaxAge {
+		doc := &nip11.RelayRetentionDocument{Time: int64(a.MaxAge.Seconds())}
+		if a.Kinds != nil {
+			doc.Kinds = [][]int{{a.Kinds.Min, a.Kinds.Max}}
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// retentionPolicies returns the retention policy of each relay.
+func retentionPolicies() map[string]RetentionPolicy {
+	return map[string]RetentionPolicy{
+		"private": privateRelayLimits.Retention,
+		"chat":    chatRelayLimits.Retention,
+		"outbox":  outboxRelayLimits.Retention,
+		"inbox":   inboxRelayLimits.Retention,
+	}
+}
+
+// runRetention compacts the relays according to their retention policies every interval, until ctx
+// is done.
+func runRetention(ctx context.Context, interval time.Duration) {
+	policies := retentionPolicies()
+	enabled := false
+	for _, policy := range policies {
+		enabled = enabled || policy.enabled()
+	}
+	if !enabled || interval <= 0 {
+		slog.Info("🧹 retention policies are disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		compactRelays(ctx, policies)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func compactRelays(ctx context.Context, policies map[string]RetentionPolicy) {
+	referenced, err := ownerReferences(ctx)
+	if err != nil {
+		slog.Error("🚫 error finding the events referenced by the owner, skipping compaction", "error", err)
+		return
+	}
+
+	for name, policy := range policies {
+		if !policy.enabled() || ctx.Err() != nil {
+			continue
+		}
+		if err := compactRelay(ctx, name, eventDBs[name], policy, referenced); err != nil {
+			slog.Error("🚫 error compacting relay", "relay", name, "error", err)
+		}
+	}
+}
+
+// compactRelay deletes the events the policy doesn't keep. Events are scanned from the newest to the
+// oldest, so the newest events of each author and the newest events within the size cap are kept.
+// Events by whitelisted pubkeys and events referenced by the owner are never deleted, but still
+// count towards the size cap.
+func compactRelay(ctx context.Context, name string, db DBBackend, policy RetentionPolicy, referenced map[string]struct{}) error {
+	now := time.Now()
+	maxSize := int64(policy.MaxSizeMB) * 1024 * 1024
+	var size int64
+	perAuthor := make(map[string]int)
+	reasons := make(map[string]int)
+
+	var expired []*nostr.Event
+	err := scanEvents(ctx, db, nostr.Filter{}, func(event *nostr.Event) {
+		size += int64(len(event.String()))
+		if config.WhitelistedPubKeys.Has(event.PubKey) || isReferenced(event, referenced) {
+			return
+		}
+		perAuthor[event.PubKey]++
+
+		var reason string
+		switch {
+		case policy.maxAge(event.Kind) > 0 && event.CreatedAt.Time().Before(now.Add(-policy.maxAge(event.Kind))):
+			reason = "age"
+		case policy.MaxEventsPerAuthor > 0 && perAuthor[event.PubKey] > policy.MaxEventsPerAuthor:
+			reason = "author"
+		case maxSize > 0 && size > maxSize:
+			reason = "size"
+		default:
+			return
+		}
+		reasons[reason]++
+		expired = append(expired, event)
+	})
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, event := range expired {
+		if err := db.DeleteEvent(ctx, event); err != nil {
+			slog.Error("🚫 error deleting event", "relay", name, "id", event.ID, "error", err)
+			continue
+		}
+		ids = append(ids, event.ID)
+	}
+	blastr.cancel(ids)
+
+	if len(ids) > 0 {
+		slog.Info("🧹 compacted relay", "relay", name, "deleted", len(ids),
+			"too_old", reasons["age"], "over_author_limit", reasons["author"], "over_size_cap", reasons["size"])
+	}
+	return nil
+}
+
+// ownerReferences returns the IDs and addresses of the events the owner referenced, through "e",
+// "q" and "a" tags, in any of the relays.
+func ownerReferences(ctx context.Context) (map[string]struct{}, error) {
+	referenced := make(map[string]struct{})
+	for _, db := range eventDBs {
+		err := scanEvents(ctx, db, nostr.Filter{Authors: []string{config.OwnerPubKey}}, func(event *nostr.Event) {
+			for _, tag := range event.Tags {
+				if len(tag) >= 2 && (tag[0] == "e" || tag[0] == "q" || tag[0] == "a") {
+					referenced[tag[1]] = struct{}{}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
+
+func isReferenced(event *nostr.Event, referenced map[string]struct{}) bool {
+	if _, ok := referenced[event.ID]; ok {
+		return true
+	}
+	if nostr.IsAddressableKind(event.Kind) || nostr.IsReplaceableKind(event.Kind) {
+		address := fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+		if _, ok := referenced[address]; ok {
+			return true
+		}
+	}
+	return false
+}
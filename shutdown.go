@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+)
+
+// background tracks work that must complete before the databases can be closed,
+// such as in-flight blastr publishes and periodic backups.
+var background = &taskGroup{}
+
+// loops tracks the long running goroutines, such as the inbox subscription and the periodic jobs,
+// which stop once the main context is cancelled. They must stop before the databases are closed.
+var loops = &taskGroup{}
+
+type taskGroup struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closing bool
+}
+
+// Add registers a new task, returning false if a shutdown is already in progress.
+func (t *taskGroup) Add() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *taskGroup) Done() {
+	t.wg.Done()
+}
+
+// Go runs fn in a new goroutine unless a shutdown is already in progress.
+func (t *taskGroup) Go(fn func()) {
+	if !t.Add() {
+		slog.Warn("⏭️ shutdown in progress, dropping background task")
+		return
+	}
+	go func() {
+		defer t.Done()
+		fn()
+	}()
+}
+
+// Wait stops accepting new tasks and blocks until the running ones finish or ctx is done.
+func (t *taskGroup) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connectionTracker keeps a reference to every open websocket of a relay, so they can be closed
+// on shutdown. Hijacked connections are not tracked by http.Server.Shutdown.
+type connectionTracker struct {
+	mu      sync.Mutex
+	conns   map[*khatru.WebSocket]struct{}
+	closing bool
+}
+
+var connections = &connectionTracker{conns: make(map[*khatru.WebSocket]struct{})}
+
+func (c *connectionTracker) track(relay *khatru.Relay) {
+	relay.RejectConnection = append(relay.RejectConnection, func(r *http.Request) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.closing
+	})
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.conns[ws] = struct{}{}
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.conns, ws)
+	})
+}
+
+// closeAll rejects new websocket connections and sends a close message to every open one.
+func (c *connectionTracker) closeAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay is shutting down")
+	for ws := range c.conns {
+		if err := ws.WriteMessage(websocket.CloseMessage, msg); err != nil {
+			slog.Debug("🚫 error closing websocket", "error", err)
+		}
+	}
+	return len(c.conns)
+}
+
+// shutdown stops the HTTP server and the relays, drains background tasks, cancels the main
+// context, waits for the loops to stop and closes all databases. It gives up waiting once
+// SHUTDOWN_TIMEOUT_SECONDS elapse, and then leaves the databases open rather than closing them
+// under a running write.
+func shutdown(srv *http.Server, cancel context.CancelFunc) {
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), timeout)
+	defer cancelTimeout()
+
+	log.Println("🛑 shutting down, waiting up to", timeout)
+
+	n := connections.closeAll()
+	slog.Info("🔌 closed websocket connections", "count", n)
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("🚫 error shutting down http server", "error", err)
+	}
+
+	if err := background.Wait(ctx); err != nil {
+		cancel()
+		logShutdownTimeout("background tasks", err, timeout)
+		return
+	}
+
+	cancel()
+	if err := loops.Wait(ctx); err != nil {
+		logShutdownTimeout("background loops", err, timeout)
+		return
+	}
+	blastr.flush()
+	closeDBs()
+}
+
+func logShutdownTimeout(what string, err error, timeout time.Duration) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("⚠️ timeout waiting for "+what+" to finish, leaving the databases open", "timeout", timeout)
+	} else {
+		slog.Error("🚫 error waiting for "+what+", leaving the databases open", "error", err)
+	}
+}
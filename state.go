@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stateDir holds small JSON files with state that must survive restarts, next to the databases.
+const stateDir = "db"
+
+func statePath(name string) string {
+	return filepath.Join(stateDir, name+".json")
+}
+
+// loadState reads the named state file into v. A missing file is reported with os.ErrNotExist.
+func loadState(name string, v any) error {
+	b, err := os.ReadFile(statePath(name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error parsing state file %s: %w", statePath(name), err)
+	}
+	return nil
+}
+
+// saveState atomically replaces the named state file with the JSON encoding of v.
+func saveState(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(stateDir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), statePath(name))
+}